@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -13,14 +14,46 @@ import (
 	"mmaxim.org/xcdistcc/common"
 )
 
+func EnvIntValue(name string, def int) (ret int) {
+	ret = def
+	envStr := os.Getenv(name)
+	parsed, err := strconv.ParseInt(envStr, 0, 0)
+	if err == nil {
+		ret = int(parsed)
+	}
+	return ret
+}
+
+// ConfigTLS configures a TLS connection to a remote. Files are PEM encoded.
+type ConfigTLS struct {
+	// CAFile has the CAs to verify the server with, the system roots if empty
+	CAFile string
+	// CertFile and KeyFile are the client certificate, for servers that require one
+	CertFile string
+	KeyFile  string
+	// ServerName is the name to verify the server certificate with, the address host if empty
+	ServerName string
+}
+
 type ConfigRemote struct {
 	Address   string
 	PublicKey string
 	Powers    []string
+	// TLS connects to the remote with TLS instead of PublicKey
+	TLS *ConfigTLS
 }
 
 func (r ConfigRemote) ToRemote() (res client.Remote, err error) {
 	res.Address = r.Address
+	if r.TLS != nil {
+		if len(r.PublicKey) > 0 {
+			return res, errors.New("remote can not have both a public key and TLS")
+		}
+		if res.TLS, err = common.NewClientTLSConfig(r.TLS.CAFile, r.TLS.CertFile, r.TLS.KeyFile,
+			r.TLS.ServerName); err != nil {
+			return res, err
+		}
+	}
 	if len(r.PublicKey) > 0 {
 		res.PublicKey = new(common.PublicKey)
 		if *res.PublicKey, err = common.NewPublicKeyFromString(r.PublicKey); err != nil {
@@ -44,6 +77,30 @@ func (r ConfigRemote) ToRemote() (res client.Remote, err error) {
 
 type ConfigFile struct {
 	Remotes []ConfigRemote
+	// PublicKey and PrivateKey are the client's identity, for servers that only accept
+	// authorized keys.
+	PublicKey  string
+	PrivateKey string
+}
+
+// ToRemotes converts the configured remotes, giving each the client identity if there is one.
+func (c ConfigFile) ToRemotes() (res []client.Remote, err error) {
+	var identity *common.KeyPair
+	if len(c.PublicKey) > 0 || len(c.PrivateKey) > 0 {
+		if identity, err = common.NewKeyPairFromString(c.PublicKey, c.PrivateKey); err != nil {
+			return nil, errors.Wrap(err, "invalid identity")
+		}
+	}
+	res = make([]client.Remote, len(c.Remotes))
+	for index, remote := range c.Remotes {
+		if res[index], err = remote.ToRemote(); err != nil {
+			return nil, errors.Wrap(err, "invalid remote")
+		}
+		if identity != nil && res[index].PublicKey != nil {
+			res[index].Identity = identity
+		}
+	}
+	return res, nil
 }
 
 func LoadConfigFile() (*ConfigFile, error) {
@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/pkg/errors"
 	"mmaxim.org/xcdistcc/bin"
@@ -14,6 +16,11 @@ type Config struct {
 	Logger         common.Logger
 	RemoteSelector client.RemoteSelector
 	Preprocessor   client.Preprocessor
+	Cache          *client.LocalCache
+	ConnPool       *client.ConnPool
+	AgentSocket    string
+	AgentMaxJobs   int
+	Dispatcher     client.DispatcherOptions
 }
 
 func LoadConfig() (config *Config, err error) {
@@ -23,11 +30,8 @@ func LoadConfig() (config *Config, err error) {
 		return nil, err
 	}
 
-	config.Remotes = make([]client.Remote, len(configFile.Remotes))
-	for index, remote := range configFile.Remotes {
-		if config.Remotes[index], err = remote.ToRemote(); err != nil {
-			return nil, errors.Wrap(err, "invalid remote")
-		}
+	if config.Remotes, err = configFile.ToRemotes(); err != nil {
+		return nil, err
 	}
 
 	// read environment variables for other config
@@ -46,6 +50,7 @@ func LoadConfig() (config *Config, err error) {
 		config.Logger = common.NewQuietLogger()
 	}
 
+	config.ConnPool = client.NewConnPool()
 	remoteSelectorStr := os.Getenv("XCDISTCC_REMOTESELECTOR")
 	switch remoteSelectorStr {
 	case "random":
@@ -53,7 +58,8 @@ func LoadConfig() (config *Config, err error) {
 	case "queuesize":
 		fallthrough
 	default:
-		config.RemoteSelector = client.NewStatusRemoteSelector(config.Remotes, config.Logger)
+		config.RemoteSelector = client.NewStatusRemoteSelector(config.Remotes, config.ConnPool,
+			time.Duration(bin.EnvIntValue("XCDISTCC_STATUSTTLMS", 500))*time.Millisecond, config.Logger)
 	}
 
 	preprocessorStr := os.Getenv("XCDISTCC_PREPROCESSOR")
@@ -62,12 +68,55 @@ func LoadConfig() (config *Config, err error) {
 		config.Preprocessor = client.NewIncludeFinder(config.Logger)
 	case "remote":
 		config.Preprocessor = client.NewRemotePreprocessor(config.RemoteSelector,
-			client.NewClangPreprocessor(config.Logger), config.Logger)
+			client.NewClangPreprocessor(config.Logger), config.ConnPool, config.Logger)
 	case "local":
 		fallthrough
 	default:
 		config.Preprocessor = client.NewClangPreprocessor(config.Logger)
 	}
 
+	config.AgentSocket = os.Getenv("XCDISTCC_AGENTSOCKET")
+	if len(config.AgentSocket) == 0 {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get user home directory")
+		}
+		config.AgentSocket = filepath.Join(homeDir, ".xcdistcc", "agent.sock")
+	}
+	config.AgentMaxJobs = bin.EnvIntValue("XCDISTCC_AGENTMAXJOBS", 64)
+
+	config.Dispatcher.MaxRetries = bin.EnvIntValue("XCDISTCC_MAXRETRIES", 1)
+	switch os.Getenv("XCDISTCC_LOCALFALLBACK") {
+	case "0", "off", "false":
+		config.Dispatcher.LocalFallback = false
+	default:
+		config.Dispatcher.LocalFallback = true
+	}
+
+	var cacheMode client.LocalCacheMode
+	cacheStr := os.Getenv("XCDISTCC_CACHE")
+	switch cacheStr {
+	case "direct":
+		cacheMode = client.LocalCacheDirect
+	case "preprocessed":
+		cacheMode = client.LocalCachePreprocessed
+	case "off":
+		fallthrough
+	default:
+		cacheMode = client.LocalCacheOff
+	}
+	if cacheMode != client.LocalCacheOff {
+		cacheDir := os.Getenv("XCDISTCC_CACHEDIR")
+		if len(cacheDir) == 0 {
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to get user home directory")
+			}
+			cacheDir = filepath.Join(homeDir, ".xcdistcc", "cache")
+		}
+		maxCacheSize := int64(bin.EnvIntValue("XCDISTCC_MAXCACHESIZE", 5120)) * 1024 * 1024
+		config.Cache = client.NewLocalCache(cacheDir, cacheMode, maxCacheSize, config.Logger)
+	}
+
 	return config, nil
 }
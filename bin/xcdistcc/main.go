@@ -1,23 +1,67 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
-	"strings"
 
 	"mmaxim.org/xcdistcc/client"
+	"mmaxim.org/xcdistcc/common"
 )
 
+func runAgent(config *Config) {
+	dispatcher := client.NewDispatcher(config.RemoteSelector, config.Preprocessor, config.Cache,
+		config.ConnPool, config.Dispatcher, config.Logger)
+	agent := client.NewAgent(dispatcher, config.AgentSocket, config.AgentMaxJobs, config.Logger)
+	if err := agent.Run(); err != nil {
+		log.Printf("failed to run agent: %s", err)
+		os.Exit(3)
+	}
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func exit(exitCode int, err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "xcdistcc: %s\n", err)
+		os.Exit(3)
+	}
+	os.Exit(exitCode)
+}
+
 func main() {
 	config, err := LoadConfig()
 	if err != nil {
 		log.Printf("failed to load config: %s", err)
 		os.Exit(3)
 	}
+	if len(os.Args) == 2 && os.Args[1] == "agent" {
+		runAgent(config)
+		return
+	}
 
-	dispatcher := client.NewDispatcher(config.RemoteSelector, config.Preprocessor, config.Logger)
-	if err := dispatcher.Run(strings.Join(os.Args[1:], " ")); err != nil {
+	wd, err := os.Getwd()
+	if err != nil {
+		log.Printf("failed to get working directory: %s", err)
 		os.Exit(3)
 	}
-	os.Exit(0)
+	job := client.Job{
+		Dir:              wd,
+		Args:             os.Args[1:],
+		Env:              common.CompilerEnv(os.Environ()),
+		ColorDiagnostics: isTerminal(os.Stderr),
+	}
+	if ran, exitCode, err := client.RunWithAgent(config.AgentSocket, job); ran {
+		exit(exitCode, err)
+	}
+
+	dispatcher := client.NewDispatcher(config.RemoteSelector, config.Preprocessor, config.Cache,
+		config.ConnPool, config.Dispatcher, config.Logger)
+	exit(dispatcher.Run(job))
 }
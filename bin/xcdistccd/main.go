@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"log"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"mmaxim.org/xcdistcc/bin"
 	"mmaxim.org/xcdistcc/common"
 	"mmaxim.org/xcdistcc/server"
 )
@@ -15,8 +19,83 @@ type Options struct {
 	Address      string
 	MaxWorkers   int
 	MaxQueueSize int
+	MaxCacheSize int
+	MaxStoreSize int
 	CxxPath      string
 	KeyPair      *common.KeyPair
+
+	ToolchainsList string
+	Toolchains     *server.Toolchains
+	TargetsList    string
+	SDKsList       string
+
+	AuthorizedKeysPath string
+	AuthorizedKeys     server.AuthorizedKeys
+	ArgPolicyPath      string
+	ArgPolicy          *server.ArgPolicy
+
+	MaxJobFiles int
+	MaxJobSize  int
+
+	PreprocessRootsList string
+	PreprocessRoots     server.SourceRoots
+
+	TLSCertPath     string
+	TLSKeyPath      string
+	TLSClientCAPath string
+	TLSConfig       *tls.Config
+
+	AllowLegacyClients bool
+
+	MaxFrameSize       int
+	MaxUnauthFrameSize int
+	HandshakeTimeout   int
+	IdleTimeout        int
+	MaxConnsPerIP      int
+	MaxRequestRate     int
+	MaxRequestBurst    int
+
+	Sandbox         bool
+	SandboxPaths    string
+	SandboxUID      int
+	SandboxGID      int
+	SandboxCPUTime  int
+	SandboxMemory   int
+	SandboxFileSize int
+}
+
+func (o Options) listenerOptions() server.ListenerOptions {
+	return server.ListenerOptions{
+		MaxFrameSize:       o.MaxFrameSize * 1024 * 1024,
+		MaxUnauthFrameSize: o.MaxUnauthFrameSize * 1024 * 1024,
+		HandshakeTimeout:   time.Duration(o.HandshakeTimeout) * time.Second,
+		IdleTimeout:        time.Duration(o.IdleTimeout) * time.Second,
+		MaxConnsPerIP:      o.MaxConnsPerIP,
+		RequestRate:        float64(o.MaxRequestRate),
+		RequestBurst:       o.MaxRequestBurst,
+		TLS:                o.TLSConfig,
+		AllowLegacyClients: o.AllowLegacyClients,
+	}
+}
+
+func (o Options) builderOptions() server.BuilderOptions {
+	return server.BuilderOptions{
+		Limits: server.JobLimits{
+			MaxFiles: o.MaxJobFiles,
+			MaxBytes: int64(o.MaxJobSize) * 1024 * 1024,
+		},
+		Roots:      o.PreprocessRoots,
+		Toolchains: o.Toolchains,
+		Sandbox: server.SandboxOptions{
+			Enabled:       o.Sandbox,
+			ReadOnlyPaths: filepath.SplitList(o.SandboxPaths),
+			UID:           o.SandboxUID,
+			GID:           o.SandboxGID,
+			CPUTime:       time.Duration(o.SandboxCPUTime) * time.Second,
+			MaxMemory:     int64(o.SandboxMemory) * 1024 * 1024,
+			MaxFileSize:   int64(o.SandboxFileSize) * 1024 * 1024,
+		},
+	}
 }
 
 func (o Options) check() {}
@@ -26,16 +105,6 @@ func usage() {
 	os.Exit(3)
 }
 
-func envIntValue(name string, def int) (ret int) {
-	ret = def
-	envStr := os.Getenv(name)
-	parsed, err := strconv.ParseInt(envStr, 0, 0)
-	if err == nil {
-		ret = int(parsed)
-	}
-	return ret
-}
-
 func configKeypair() (*common.KeyPair, error) {
 	publicStr := os.Getenv("XCDISTCCD_PUBLICKEY")
 	if len(publicStr) == 0 {
@@ -52,12 +121,87 @@ func config() (opts Options) {
 
 	flag.StringVar(&opts.Address, "address", os.Getenv("XCDISTCCD_ADDRESS"),
 		"(optional) listen address (XCDISTCCD_ADDRESS env)")
-	flag.IntVar(&opts.MaxWorkers, "max-workers", envIntValue("XCDISTCCD_MAXWORKERS", 5),
+	flag.IntVar(&opts.MaxWorkers, "max-workers", bin.EnvIntValue("XCDISTCCD_MAXWORKERS", 5),
 		"(optional) max compile workers (XCDISTCCD_MAXWORKERS env)")
-	flag.IntVar(&opts.MaxQueueSize, "max-queue-size", envIntValue("XCDISTCCD_MAXQUEUESIZE", 500),
+	flag.IntVar(&opts.MaxQueueSize, "max-queue-size", bin.EnvIntValue("XCDISTCCD_MAXQUEUESIZE", 500),
 		"(optional) max compile queue size (XCDISTCCD_MAXQUEUESIZE env)")
+	flag.IntVar(&opts.MaxCacheSize, "max-cache-size", bin.EnvIntValue("XCDISTCCD_MAXCACHESIZE", 256),
+		"(optional) max compile result cache size in MB, 0 disables (XCDISTCCD_MAXCACHESIZE env)")
+	flag.IntVar(&opts.MaxStoreSize, "max-include-store-size", bin.EnvIntValue("XCDISTCCD_MAXINCLUDESTORESIZE", 512),
+		"(optional) max shipped header store size in MB (XCDISTCCD_MAXINCLUDESTORESIZE env)")
 	flag.StringVar(&opts.CxxPath, "cxx-path", os.Getenv("XCDISTCCD_CXXPATH"),
-		"(optional) xcode c++ compiler path (XCDISTCCD_CXXPATH env)")
+		"(optional) xcode c++ compiler path, the default toolchain (XCDISTCCD_CXXPATH env)")
+	flag.StringVar(&opts.ToolchainsList, "toolchains", os.Getenv("XCDISTCCD_TOOLCHAINS"),
+		"(optional) list of more compilers to serve, each a path or NAME=PATH, separated like PATH; clients get "+
+			"the one in the directory of the compiler they ran (XCDISTCCD_TOOLCHAINS env)")
+	flag.StringVar(&opts.TargetsList, "targets", os.Getenv("XCDISTCCD_TARGETS"),
+		"(optional) comma separated architectures to build for, such as arm64,x86_64, instead of asking the "+
+			"toolchains (XCDISTCCD_TARGETS env)")
+	flag.StringVar(&opts.SDKsList, "sdks", os.Getenv("XCDISTCCD_SDKS"),
+		"(optional) comma separated SDK names to build with, such as MacOSX14.2,iPhoneOS17.2, instead of the "+
+			"ones in the toolchains' Xcode (XCDISTCCD_SDKS env)")
+	flag.StringVar(&opts.AuthorizedKeysPath, "authorized-keys", os.Getenv("XCDISTCCD_AUTHORIZEDKEYS"),
+		"(optional) file of client public keys allowed to connect, one per line with an optional name "+
+			"(XCDISTCCD_AUTHORIZEDKEYS env)")
+	flag.StringVar(&opts.ArgPolicyPath, "arg-policy", os.Getenv("XCDISTCCD_ARGPOLICY"),
+		"(optional) file of compiler argument rules checked before the defaults, one \"allow PATTERN\" or "+
+			"\"deny PATTERN\" per line (XCDISTCCD_ARGPOLICY env)")
+	flag.IntVar(&opts.MaxJobFiles, "max-job-files", bin.EnvIntValue("XCDISTCCD_MAXJOBFILES", 50000),
+		"(optional) max files one compile job may ship (XCDISTCCD_MAXJOBFILES env)")
+	flag.IntVar(&opts.MaxJobSize, "max-job-size", bin.EnvIntValue("XCDISTCCD_MAXJOBSIZE", 1024),
+		"(optional) max size in MB of the files one compile job may ship (XCDISTCCD_MAXJOBSIZE env)")
+	flag.StringVar(&opts.PreprocessRootsList, "preprocess-roots", os.Getenv("XCDISTCCD_PREPROCESSROOTS"),
+		"(optional) list of shared directories remote preprocessing may use, separated like PATH, including "+
+			"the Xcode and SDK directories; remote preprocessing is disabled without it "+
+			"(XCDISTCCD_PREPROCESSROOTS env)")
+	flag.StringVar(&opts.TLSCertPath, "tls-cert", os.Getenv("XCDISTCCD_TLSCERT"),
+		"(optional) PEM certificate to serve TLS 1.3 with instead of the key pair handshake, needs -tls-key "+
+			"(XCDISTCCD_TLSCERT env)")
+	flag.StringVar(&opts.TLSKeyPath, "tls-key", os.Getenv("XCDISTCCD_TLSKEY"),
+		"(optional) PEM private key of the TLS certificate (XCDISTCCD_TLSKEY env)")
+	flag.StringVar(&opts.TLSClientCAPath, "tls-client-ca", os.Getenv("XCDISTCCD_TLSCLIENTCA"),
+		"(optional) PEM CA certificates that client certificates must be signed by, which makes them required "+
+			"(XCDISTCCD_TLSCLIENTCA env)")
+	flag.BoolVar(&opts.AllowLegacyClients, "allow-legacy-clients", os.Getenv("XCDISTCCD_ALLOWLEGACYCLIENTS") == "1",
+		"(optional) accept older clients with the handshake that has no key confirmation or forward secrecy, "+
+			"ignored with -authorized-keys (XCDISTCCD_ALLOWLEGACYCLIENTS=1 env)")
+	flag.IntVar(&opts.MaxFrameSize, "max-frame-size", bin.EnvIntValue("XCDISTCCD_MAXFRAMESIZE", 256),
+		"(optional) max client message size in MB (XCDISTCCD_MAXFRAMESIZE env)")
+	flag.IntVar(&opts.MaxUnauthFrameSize, "max-unauth-frame-size", bin.EnvIntValue("XCDISTCCD_MAXUNAUTHFRAMESIZE", 32),
+		"(optional) max message size in MB from clients that have not authenticated with an authorized key or "+
+			"client certificate (XCDISTCCD_MAXUNAUTHFRAMESIZE env)")
+	flag.IntVar(&opts.HandshakeTimeout, "handshake-timeout", bin.EnvIntValue("XCDISTCCD_HANDSHAKETIMEOUT", 10),
+		"(optional) seconds a client has to complete the handshake (XCDISTCCD_HANDSHAKETIMEOUT env)")
+	flag.IntVar(&opts.IdleTimeout, "idle-timeout", bin.EnvIntValue("XCDISTCCD_IDLETIMEOUT", 600),
+		"(optional) seconds before closing a connection with no commands in flight, 0 disables "+
+			"(XCDISTCCD_IDLETIMEOUT env)")
+	flag.IntVar(&opts.MaxConnsPerIP, "max-conns-per-ip", bin.EnvIntValue("XCDISTCCD_MAXCONNSPERIP", 64),
+		"(optional) max open connections from one address, 0 disables (XCDISTCCD_MAXCONNSPERIP env)")
+	flag.IntVar(&opts.MaxRequestRate, "max-request-rate", bin.EnvIntValue("XCDISTCCD_MAXREQUESTRATE", 0),
+		"(optional) max requests per second from one address, 0 disables (XCDISTCCD_MAXREQUESTRATE env)")
+	flag.IntVar(&opts.MaxRequestBurst, "max-request-burst", bin.EnvIntValue("XCDISTCCD_MAXREQUESTBURST", 0),
+		"(optional) requests one address may send at once above its rate, defaults to one second's worth "+
+			"(XCDISTCCD_MAXREQUESTBURST env)")
+	flag.BoolVar(&opts.Sandbox, "sandbox", os.Getenv("XCDISTCCD_SANDBOX") == "1",
+		"(optional) run compilers in namespaces with a read only view of the system, Linux only "+
+			"(XCDISTCCD_SANDBOX=1 env)")
+	flag.StringVar(&opts.SandboxPaths, "sandbox-paths", os.Getenv("XCDISTCCD_SANDBOXPATHS"),
+		"(optional) list of extra read only paths visible to sandboxed compilers, such as SDKs, separated "+
+			"like PATH (XCDISTCCD_SANDBOXPATHS env)")
+	flag.IntVar(&opts.SandboxUID, "sandbox-uid", bin.EnvIntValue("XCDISTCCD_SANDBOXUID", 0),
+		"(optional) uid sandboxed compilers run as when the daemon is root, defaults to nobody "+
+			"(XCDISTCCD_SANDBOXUID env)")
+	flag.IntVar(&opts.SandboxGID, "sandbox-gid", bin.EnvIntValue("XCDISTCCD_SANDBOXGID", 0),
+		"(optional) gid sandboxed compilers run as when the daemon is root, defaults to nogroup "+
+			"(XCDISTCCD_SANDBOXGID env)")
+	flag.IntVar(&opts.SandboxCPUTime, "sandbox-cpu-time", bin.EnvIntValue("XCDISTCCD_SANDBOXCPUTIME", 300),
+		"(optional) max CPU seconds of a sandboxed compiler, 0 disables (XCDISTCCD_SANDBOXCPUTIME env)")
+	flag.IntVar(&opts.SandboxMemory, "sandbox-max-memory", bin.EnvIntValue("XCDISTCCD_SANDBOXMAXMEMORY", 4096),
+		"(optional) max address space in MB of a sandboxed compiler, 0 disables "+
+			"(XCDISTCCD_SANDBOXMAXMEMORY env)")
+	flag.IntVar(&opts.SandboxFileSize, "sandbox-max-file-size", bin.EnvIntValue("XCDISTCCD_SANDBOXMAXFILESIZE", 1024),
+		"(optional) max size in MB of a file written by a sandboxed compiler, 0 disables "+
+			"(XCDISTCCD_SANDBOXMAXFILESIZE env)")
 	flag.Parse()
 	opts.check()
 
@@ -67,6 +211,62 @@ func config() (opts Options) {
 		log.Printf("unable to configure key pair: %s", err)
 		os.Exit(3)
 	}
+	if len(opts.AuthorizedKeysPath) > 0 {
+		if opts.KeyPair == nil {
+			log.Printf("authorized keys require a server key pair")
+			os.Exit(3)
+		}
+		if opts.AuthorizedKeys, err = server.LoadAuthorizedKeys(opts.AuthorizedKeysPath); err != nil {
+			log.Printf("unable to load authorized keys: %s", err)
+			os.Exit(3)
+		}
+	}
+	if len(opts.TLSCertPath) > 0 || len(opts.TLSKeyPath) > 0 {
+		if opts.KeyPair != nil || len(opts.AuthorizedKeysPath) > 0 {
+			log.Printf("TLS can not be used with a server key pair or authorized keys")
+			os.Exit(3)
+		}
+		if opts.TLSConfig, err = common.NewServerTLSConfig(opts.TLSCertPath, opts.TLSKeyPath,
+			opts.TLSClientCAPath); err != nil {
+			log.Printf("unable to configure TLS: %s", err)
+			os.Exit(3)
+		}
+	} else if len(opts.TLSClientCAPath) > 0 {
+		log.Printf("TLS client CA requires a TLS certificate")
+		os.Exit(3)
+	}
+	toolchains := filepath.SplitList(opts.ToolchainsList)
+	if len(opts.CxxPath) > 0 {
+		toolchains = append([]string{opts.CxxPath}, toolchains...)
+	}
+	if opts.Toolchains, err = server.NewToolchains(toolchains); err != nil {
+		log.Printf("unable to configure toolchains: %s", err)
+		os.Exit(3)
+	}
+	if len(opts.TargetsList) > 0 {
+		var targets []string
+		for _, arch := range strings.Split(opts.TargetsList, ",") {
+			targets = append(targets, common.NormalizeArch(strings.TrimSpace(arch)))
+		}
+		opts.Toolchains.SetTargets(targets)
+	}
+	if len(opts.SDKsList) > 0 {
+		var sdks []string
+		for _, sdk := range strings.Split(opts.SDKsList, ",") {
+			sdks = append(sdks, strings.TrimSpace(sdk))
+		}
+		opts.Toolchains.SetSDKs(sdks)
+	}
+	if len(opts.ArgPolicyPath) > 0 {
+		if opts.ArgPolicy, err = server.LoadArgPolicy(opts.ArgPolicyPath); err != nil {
+			log.Printf("unable to load argument policy: %s", err)
+			os.Exit(3)
+		}
+	}
+	if opts.PreprocessRoots, err = server.NewSourceRoots(filepath.SplitList(opts.PreprocessRootsList)); err != nil {
+		log.Printf("unable to configure preprocess roots: %s", err)
+		os.Exit(3)
+	}
 	return opts
 }
 
@@ -78,11 +278,17 @@ func getOptional(val, def string) string {
 }
 
 func main() {
+	// a sandboxed compiler starts as a copy of the daemon that sets up the sandbox
+	server.RunSandboxHelper()
 	opts := config()
 	logger := common.NewStdLogger()
-	runner := server.NewRunner(opts.MaxWorkers, opts.MaxQueueSize, logger)
+	runner, err := server.NewRunner(opts.MaxWorkers, opts.MaxQueueSize, int64(opts.MaxCacheSize)*1024*1024,
+		int64(opts.MaxStoreSize)*1024*1024, opts.ArgPolicy, opts.builderOptions(), logger)
+	if err != nil {
+		log.Fatalf("unable to make runner: %s", err)
+	}
 	listener := server.NewListener(runner, getOptional(opts.Address, common.DefaultListenAddress),
-		opts.KeyPair, logger)
+		opts.KeyPair, opts.AuthorizedKeys, opts.listenerOptions(), logger)
 	if err := listener.Run(); err != nil {
 		log.Fatalf("error running listener: %s", err)
 	}
@@ -6,7 +6,6 @@ import (
 
 	"fyne.io/fyne/v2/app"
 	"mmaxim.org/xcdistcc/bin"
-	"mmaxim.org/xcdistcc/client"
 	"mmaxim.org/xcdistcc/ui"
 )
 
@@ -17,12 +16,10 @@ func main() {
 		os.Exit(3)
 	}
 
-	remotes := make([]client.Remote, len(configFile.Remotes))
-	for index, remote := range configFile.Remotes {
-		if remotes[index], err = remote.ToRemote(); err != nil {
-			log.Printf("invalid remote: %s", err)
-			os.Exit(3)
-		}
+	remotes, err := configFile.ToRemotes()
+	if err != nil {
+		log.Printf("invalid config: %s", err)
+		os.Exit(3)
 	}
 
 	a := app.New()
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"mmaxim.org/xcdistcc/common"
+)
+
+// Agent is a long-running per-user process that runs jobs on behalf of short-lived compiler
+// wrapper processes, so connections, remote status and include scans stay warm across a build.
+type Agent struct {
+	*common.LabelLogger
+	dispatcher *Dispatcher
+	socketPath string
+	jobSem     chan struct{}
+}
+
+func NewAgent(dispatcher *Dispatcher, socketPath string, maxJobs int, logger common.Logger) *Agent {
+	return &Agent{
+		LabelLogger: common.NewLabelLogger("Agent", logger),
+		dispatcher:  dispatcher,
+		socketPath:  socketPath,
+		jobSem:      make(chan struct{}, maxJobs),
+	}
+}
+
+func (a *Agent) Run() error {
+	if err := os.MkdirAll(filepath.Dir(a.socketPath), 0700); err != nil {
+		return errors.Wrap(err, "failed to make socket dir")
+	}
+	// a socket left behind by an agent that did not shut down cleanly blocks listening
+	if conn, err := net.Dial("unix", a.socketPath); err == nil {
+		conn.Close()
+		return errors.New("agent already running")
+	}
+	os.Remove(a.socketPath)
+	listener, err := net.Listen("unix", a.socketPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen")
+	}
+	defer listener.Close()
+	if err := os.Chmod(a.socketPath, 0600); err != nil {
+		return errors.Wrap(err, "failed to set socket permissions")
+	}
+	a.Debug("listening on: %s max jobs: %d", a.socketPath, cap(a.jobSem))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return errors.Wrap(err, "failed to accept")
+		}
+		go a.serve(conn)
+	}
+}
+
+func (a *Agent) runJob(cmd common.AgentRunCmd) (res common.AgentRunResponse) {
+	a.jobSem <- struct{}{}
+	defer func() { <-a.jobSem }()
+	var stdout, stderr bytes.Buffer
+	exitCode, err := a.dispatcher.Run(Job{
+		Dir:              cmd.Dir,
+		Args:             cmd.Args,
+		Env:              cmd.Env,
+		Stdout:           &stdout,
+		Stderr:           &stderr,
+		ColorDiagnostics: cmd.ColorDiagnostics,
+	})
+	if err != nil {
+		res.Error = new(string)
+		*res.Error = err.Error()
+	}
+	res.Stdout = stdout.Bytes()
+	res.Stderr = stderr.Bytes()
+	res.ExitCode = exitCode
+	return res
+}
+
+func (a *Agent) sendResponse(conn net.Conn, sendMu *sync.Mutex, id uint64, payload any) error {
+	response := common.CmdResponse{
+		ID:      id,
+		Success: true,
+	}
+	dat, err := msgpack.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	response.Payload = dat
+	if dat, err = msgpack.Marshal(response); err != nil {
+		return err
+	}
+	sendMu.Lock()
+	defer sendMu.Unlock()
+	return common.RPCSendRaw(conn, dat, nil)
+}
+
+func (a *Agent) serve(conn net.Conn) {
+	defer conn.Close()
+	var sendMu sync.Mutex
+	for {
+		dat, err := common.RPCRecvRaw(conn, nil, common.DefaultMaxFrameSize)
+		if err != nil {
+			return
+		}
+		var cmd common.Cmd
+		if err := msgpack.Unmarshal(dat, &cmd); err != nil {
+			a.Debug("serve: invalid msgpack: %s", err)
+			return
+		}
+		if cmd.Name != common.MethodAgentRun {
+			a.Debug("serve: unknown command: %s", cmd.Name)
+			return
+		}
+		var run common.AgentRunCmd
+		if err := msgpack.Unmarshal(cmd.Args, &run); err != nil {
+			a.Debug("serve: failed to parse run args: %s", err)
+			return
+		}
+		go func() {
+			if err := a.sendResponse(conn, &sendMu, cmd.ID, a.runJob(run)); err != nil {
+				a.Debug("serve: failed to send response: %s", err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// RunWithAgent hands job to the agent listening on socketPath, and returns the compiler exit
+// code like Dispatcher.Run. The returned bool is false if no agent is available or the agent went
+// away, in which case the caller should run the job itself.
+func RunWithAgent(socketPath string, job Job) (bool, int, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return false, 0, nil
+	}
+	mconn := common.NewMuxConn(conn, nil)
+	defer mconn.Close()
+	res, err := common.DoRPC[common.AgentRunCmd, common.AgentRunResponse](mconn, common.MethodAgentRun,
+		common.AgentRunCmd{
+			Dir:              job.Dir,
+			Args:             job.Args,
+			Env:              job.Env,
+			ColorDiagnostics: job.ColorDiagnostics,
+		})
+	if err != nil {
+		return false, 0, nil
+	}
+	job.stdout().Write(res.Stdout)
+	job.stderr().Write(res.Stderr)
+	if res.Error != nil {
+		return true, 0, errors.New(*res.Error)
+	}
+	return true, res.ExitCode, nil
+}
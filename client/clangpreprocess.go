@@ -1,6 +1,8 @@
 package client
 
 import (
+	"io"
+	"os"
 	"os/exec"
 
 	"github.com/pkg/errors"
@@ -9,7 +11,6 @@ import (
 
 type ClangPreprocessor struct {
 	*common.LabelLogger
-	dir string
 }
 
 func NewClangPreprocessor(logger common.Logger) *ClangPreprocessor {
@@ -18,28 +19,54 @@ func NewClangPreprocessor(logger common.Logger) *ClangPreprocessor {
 	}
 }
 
-func (c *ClangPreprocessor) Preprocess(basecmd *common.XcodeCmd) ([]byte, *common.XcodeCmd, []common.IncludeData, error) {
+// PreprocessorCmd returns the arguments, without the compiler, that preprocess basecmd to stdout.
+func PreprocessorCmd(basecmd *common.XcodeCmd) *common.XcodeCmd {
 	precmd := basecmd.Clone()
-	retcmd := basecmd.Clone()
 	precmd.StripCompiler()
 	precmd.SetPreprocessorOnly()
 	precmd.RemoveOutputFilepath()
+	return precmd
+}
+
+// Preprocess preprocesses basecmd with the compiler it was invoked with.
+func (c *ClangPreprocessor) Preprocess(basecmd *common.XcodeCmd, stderr io.Writer) ([]byte, *common.XcodeCmd, []common.IncludeData, error) {
+	return c.PreprocessWith(basecmd.GetCompiler(), basecmd, stderr)
+}
 
-	cmd := exec.Command(common.DefaultCXX, precmd.GetTokens()...)
-	if len(c.dir) > 0 {
-		cmd.Dir = c.dir
+// PreprocessWith preprocesses basecmd with compiler.
+func (c *ClangPreprocessor) PreprocessWith(compiler string, basecmd *common.XcodeCmd, stderr io.Writer) ([]byte, *common.XcodeCmd, []common.IncludeData, error) {
+	if !basecmd.PreprocessesInput() {
+		// plain assembly goes to the remote as it is
+		return c.readInput(basecmd)
 	}
-	out, err := cmd.CombinedOutput()
+	precmd := PreprocessorCmd(basecmd)
+	retcmd := basecmd.Clone()
+
+	cmd := exec.Command(compiler, precmd.GetTokens()...)
+	cmd.Dir = basecmd.GetDir()
+	cmd.Env = basecmd.Environ()
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
 	if err != nil {
-		c.Debug("preprocess failed: %s", string(out[:]))
-		c.Debug("done")
+		c.Debug("preprocess failed: %s", err)
 		return nil, nil, nil, errors.Wrap(err, "preprocess failed")
 	}
-	retcmd.RemoveDepFilepath()
+	retcmd.RemoveDepFlags()
 	return out, retcmd, nil, nil
 
 }
 
-func (c *ClangPreprocessor) SetDirectory(dir string) {
-	c.dir = dir
+func (c *ClangPreprocessor) readInput(basecmd *common.XcodeCmd) ([]byte, *common.XcodeCmd, []common.IncludeData, error) {
+	input, err := basecmd.GetInputFilepath()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if input, err = basecmd.AbsPath(input); err != nil {
+		return nil, nil, nil, err
+	}
+	code, err := os.ReadFile(input)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to read input file")
+	}
+	return code, basecmd.Clone(), nil, nil
 }
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"sync"
+)
+
+type connPoolEntry struct {
+	sync.Mutex
+	conn *RemoteConn
+}
+
+// ConnPool keeps one long-lived multiplexed connection per remote, redialing only once the
+// previous connection has failed.
+type ConnPool struct {
+	sync.Mutex
+	entries map[string]*connPoolEntry
+}
+
+func NewConnPool() *ConnPool {
+	return &ConnPool{
+		entries: make(map[string]*connPoolEntry),
+	}
+}
+
+func (p *ConnPool) entry(address string) *connPoolEntry {
+	p.Lock()
+	defer p.Unlock()
+	entry, ok := p.entries[address]
+	if !ok {
+		entry = new(connPoolEntry)
+		p.entries[address] = entry
+	}
+	return entry
+}
+
+func (p *ConnPool) Get(remote Remote) (*RemoteConn, error) {
+	entry := p.entry(remote.Address)
+	entry.Lock()
+	defer entry.Unlock()
+	if entry.conn != nil && !entry.conn.IsClosed() {
+		return entry.conn, nil
+	}
+	conn, err := DialRemote(remote)
+	if err != nil {
+		return nil, err
+	}
+	entry.conn = conn
+	return conn, nil
+}
+
+func (p *ConnPool) Close() {
+	p.Lock()
+	defer p.Unlock()
+	for address, entry := range p.entries {
+		entry.Lock()
+		if entry.conn != nil {
+			entry.conn.Close()
+		}
+		entry.Unlock()
+		delete(p.entries, address)
+	}
+}
@@ -1,97 +1,501 @@
 package client
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"runtime"
 	"time"
 
 	"mmaxim.org/xcdistcc/common"
 )
 
+// RemoteQuery narrows down which remotes a RemoteSelector may return.
+type RemoteQuery struct {
+	// Exclude lists the addresses of remotes that must not be returned
+	Exclude []string
+	// Target is what the job builds for. Selectors that know what remotes build for only return
+	// ones that support it.
+	Target common.Target
+}
+
+func (q RemoteQuery) allows(remote Remote) bool {
+	for _, address := range q.Exclude {
+		if address == remote.Address {
+			return false
+		}
+	}
+	return true
+}
+
+func (q RemoteQuery) filter(remotes []Remote) (res []Remote) {
+	for _, remote := range remotes {
+		if q.allows(remote) {
+			res = append(res, remote)
+		}
+	}
+	return res
+}
+
 type RemoteSelector interface {
-	GetRemote() (Remote, error)
-	GetRemoteWithPreprocessor() (Remote, error)
+	GetRemote(query RemoteQuery) (Remote, error)
+	GetRemoteWithPreprocessor(query RemoteQuery) (Remote, error)
 }
 
+// Preprocessor produces the code to send to a remote for cmd. Diagnostics from preprocessing are
+// written to stderr.
 type Preprocessor interface {
-	Preprocess(cmd *common.XcodeCmd) ([]byte, *common.XcodeCmd, []common.IncludeData, error)
+	Preprocess(cmd *common.XcodeCmd, stderr io.Writer) ([]byte, *common.XcodeCmd, []common.IncludeData, error)
+}
+
+// Job is a single compiler invocation, run as if from Dir. Compiler output is written to Stdout
+// and Stderr, or the process's own if they are nil.
+type Job struct {
+	Dir  string
+	Args []string
+	// Env is the compiler environment of the invoking process, see common.CompilerEnvVars. Jobs
+	// without one run with the environment of this process.
+	Env    map[string]string
+	Stdout io.Writer
+	Stderr io.Writer
+	// ColorDiagnostics requests colored compiler diagnostics, for when the output is a terminal
+	ColorDiagnostics bool
+}
+
+func (j Job) stdout() io.Writer {
+	if j.Stdout == nil {
+		return os.Stdout
+	}
+	return j.Stdout
+}
+
+func (j Job) stderr() io.Writer {
+	if j.Stderr == nil {
+		return os.Stderr
+	}
+	return j.Stderr
+}
+
+type DispatcherOptions struct {
+	// MaxRetries is how many other remotes to try after an infrastructure failure
+	MaxRetries int
+	// LocalFallback runs the job on this machine when no remote could run it
+	LocalFallback bool
 }
 
 type Dispatcher struct {
 	*common.LabelLogger
 	remoteSelector RemoteSelector
 	preprocessor   Preprocessor
+	cache          *LocalCache
+	connPool       *ConnPool
+	opts           DispatcherOptions
 }
 
-func NewDispatcher(remoteSelector RemoteSelector, preprocessor Preprocessor, logger common.Logger) *Dispatcher {
+func NewDispatcher(remoteSelector RemoteSelector, preprocessor Preprocessor, cache *LocalCache,
+	connPool *ConnPool, opts DispatcherOptions, logger common.Logger) *Dispatcher {
 	return &Dispatcher{
 		LabelLogger:    common.NewLabelLogger("Dispatcher", logger),
 		remoteSelector: remoteSelector,
 		preprocessor:   preprocessor,
+		cache:          cache,
+		connPool:       connPool,
+		opts:           opts,
+	}
+}
+
+// IsInfraError returns whether err is a failure to get a job run, such as a dial error, timeout,
+// full queue or decrypt failure, as opposed to the compiler or the server's policy rejecting the
+// job, which another remote would do as well.
+func IsInfraError(err error) bool {
+	var rerr common.RPCError
+	if errors.As(err, &rerr) {
+		switch rerr.Code {
+		case common.ErrorCodeGeneric, common.ErrorCodeCompile, common.ErrorCodePolicy,
+			common.ErrorCodePermission:
+			return false
+		}
+		return true
+	}
+	return err != nil
+}
+
+// compileFailure returns the compiler output of err if it is the compiler rejecting the job.
+func compileFailure(err error) (string, bool) {
+	var rerr common.RPCError
+	if errors.As(err, &rerr) && (rerr.Code == common.ErrorCodeGeneric || rerr.Code == common.ErrorCodeCompile) {
+		return rerr.Msg, true
+	}
+	return "", false
+}
+
+// runLocal runs the job's original command on this machine.
+func (d *Dispatcher) runLocal(job Job) (int, error) {
+	xccmd := common.NewXcodeCmd(job.Args)
+	compiler := xccmd.GetCompiler()
+	xccmd.StripCompiler()
+	if job.ColorDiagnostics {
+		xccmd.SetColorDiagnostics()
+	}
+	d.Debug("running locally: %q", job.Args)
+	xccmd.SetEnv(job.Env)
+	cmd := exec.Command(compiler, xccmd.GetTokens()...)
+	cmd.Dir = job.Dir
+	cmd.Env = xccmd.Environ()
+	cmd.Stdout = job.stdout()
+	cmd.Stderr = job.stderr()
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode(), nil
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (d *Dispatcher) compileRemote(remote Remote, compileCmd common.CompileCmd,
+	includeData []common.IncludeData) (res common.CompileResponse, err error) {
+	conn, err := d.connPool.Get(remote)
+	if err != nil {
+		return res, err
+	}
+	if len(includeData) > 0 {
+		if compileCmd.IncludeRefs, err = d.uploadIncludes(conn, includeData); err != nil {
+			// older servers drop the connection on methods they do not know, so redial and ship the
+			// headers inline
+			d.Debug("failed to upload includes, sending inline: %s", err)
+			if conn, err = d.connPool.Get(remote); err != nil {
+				return res, err
+			}
+			compileCmd.Includes = includeData
+		}
+	}
+	res, err = common.DoRPC[common.CompileCmd, common.CompileResponse](conn, common.MethodCompile, compileCmd)
+	var rerr common.RPCError
+	if errors.As(err, &rerr) && rerr.Code == common.ErrorCodeMissingIncludes && len(compileCmd.IncludeRefs) > 0 {
+		// other uploads evicted headers since we checked, so ship them all with the job
+		d.Debug("remote lost includes, sending inline: %s", err)
+		compileCmd.IncludeRefs = nil
+		compileCmd.Includes = includeData
+		res, err = common.DoRPC[common.CompileCmd, common.CompileResponse](conn, common.MethodCompile, compileCmd)
+	}
+	if err != nil {
+		return res, err
+	}
+	if len(res.Files) == 0 && res.ExitCode == 0 &&
+		common.NewXcodeCmd(compileCmd.Args).ClassifyFlags().ExtraOutputs {
+		// servers that predate ProtocolVersion 2 only return the object and dep file
+		return res, errors.New("remote does not return all output files")
 	}
+	return res, nil
 }
 
-func (d *Dispatcher) getConn() (*RemoteConn, error) {
-	remote, err := d.remoteSelector.GetRemote()
+// uploadIncludes sends the remote only the headers it does not already have, and returns
+// references to all of them for use in the compile command.
+func (d *Dispatcher) uploadIncludes(conn *RemoteConn, includeData []common.IncludeData) (refs []common.IncludeRef, err error) {
+	blobs := make(map[string]string, len(includeData))
+	digests := make([]string, 0, len(includeData))
+	for _, include := range includeData {
+		digest := common.DigestBytes([]byte(include.Data))
+		refs = append(refs, common.IncludeRef{
+			Path:   include.Path,
+			Digest: digest,
+		})
+		if _, ok := blobs[digest]; !ok {
+			blobs[digest] = include.Data
+			digests = append(digests, digest)
+		}
+	}
+	check, err := common.DoRPC[common.CheckIncludesCmd, common.CheckIncludesResponse](conn,
+		common.MethodCheckIncludes, common.CheckIncludesCmd{
+			Digests: digests,
+		})
 	if err != nil {
 		return nil, err
 	}
-	return DialRemote(remote)
+	var upload common.UploadIncludesCmd
+	for _, digest := range check.Missing {
+		if dat, ok := blobs[digest]; ok {
+			upload.Blobs = append(upload.Blobs, common.IncludeBlob{
+				Digest: digest,
+				Data:   dat,
+			})
+		}
+	}
+	if len(upload.Blobs) > 0 {
+		if _, err := common.DoRPC[common.UploadIncludesCmd, common.UploadIncludesResponse](conn,
+			common.MethodUploadIncludes, upload); err != nil {
+			return nil, err
+		}
+	}
+	d.Debug("uploadIncludes: total: %d unique: %d uploaded: %d", len(refs), len(digests), len(upload.Blobs))
+	return refs, nil
 }
 
-func (d *Dispatcher) Run(cmdstr string) error {
-	xccmd := common.NewXcodeCmd(cmdstr)
-	xccmd.SetArch(runtime.GOARCH)
+// outputPaths returns the object and dep file of cmd, along with any other files written for it.
+func (d *Dispatcher) outputPaths(cmd *common.XcodeCmd, written []string) (res []string) {
+	if outputPath, err := cmd.GetOutputFilepath(); err == nil {
+		res = append(res, outputPath)
+	}
+	if depPath, err := cmd.GetDepFilepath(); err == nil {
+		res = append(res, depPath)
+	}
+	seen := make(map[string]bool)
+	for index, path := range res {
+		if abspath, err := cmd.AbsPath(path); err == nil {
+			res[index] = abspath
+		}
+		seen[res[index]] = true
+	}
+	for _, path := range written {
+		if !seen[path] {
+			res = append(res, path)
+			seen[path] = true
+		}
+	}
+	return res
+}
+
+// checkOutputs returns an error if cmdresp has a file that xccmd does not write, so a server can
+// not write anywhere else on this machine.
+func checkOutputs(xccmd *common.XcodeCmd, cmdresp common.CompileResponse) error {
+	for _, file := range cmdresp.Files {
+		path, err := xccmd.AbsPath(file.Path)
+		if err != nil {
+			return err
+		}
+		if !xccmd.AllowsOutput(path) {
+			return fmt.Errorf("remote sent a file the command does not write: %s", file.Path)
+		}
+	}
+	return nil
+}
+
+// writeOutputs writes the files in cmdresp and returns their paths.
+func (d *Dispatcher) writeOutputs(xccmd *common.XcodeCmd, outputPath string,
+	cmdresp common.CompileResponse) (written []string, err error) {
+	if len(cmdresp.Files) > 0 {
+		for _, file := range cmdresp.Files {
+			path, err := xccmd.AbsPath(file.Path)
+			if err != nil {
+				return nil, err
+			}
+			if err := common.WriteFileCreatePath(path, file.Data); err != nil {
+				d.Debug("failed to write output file: %s", err)
+				return nil, err
+			}
+			written = append(written, path)
+		}
+		return written, nil
+	}
+	if cmdresp.ExitCode != 0 {
+		return nil, nil
+	}
+	// write dep file if one was specified
+	depPath, err := xccmd.GetDepFilepath()
+	if err == nil {
+		if depPath, err = xccmd.AbsPath(depPath); err != nil {
+			return nil, err
+		}
+		if err := common.WriteFileCreatePath(depPath, cmdresp.Dep); err != nil {
+			d.Debug("failed to write dep file: %s", err)
+			return nil, err
+		}
+		written = append(written, depPath)
+	}
+	if err := common.WriteFileCreatePath(outputPath, cmdresp.Object); err != nil {
+		d.Debug("failed to write output file: %s", err)
+		return nil, err
+	}
+	return append(written, outputPath), nil
+}
+
+func (d *Dispatcher) storeDirect(cmd *common.XcodeCmd, directKey, resultKey string, code []byte,
+	includeData []common.IncludeData) {
+	if len(directKey) == 0 {
+		return
+	}
+	var headers []string
+	if len(includeData) > 0 {
+		for _, include := range includeData {
+			headers = append(headers, include.Path)
+		}
+	} else {
+		var err error
+		if headers, err = HeadersFromPreprocessed(code); err != nil {
+			d.Debug("failed to find headers for direct cache manifest: %s", err)
+			return
+		}
+	}
+	for index, header := range headers {
+		if abspath, err := cmd.AbsPath(header); err == nil {
+			headers[index] = abspath
+		}
+	}
+	if err := d.cache.StoreDirect(directKey, resultKey, headers); err != nil {
+		d.Debug("failed to store direct cache manifest: %s", err)
+	}
+}
+
+// Run runs job and returns the exit code of the compiler. An error is returned only when the job
+// could not be run at all.
+func (d *Dispatcher) Run(job Job) (int, error) {
+	xccmd := common.NewXcodeCmd(job.Args)
+	xccmd.SetDir(job.Dir)
+	if job.Env == nil {
+		xccmd.SetEnv(common.CompilerEnv(os.Environ()))
+	} else {
+		xccmd.SetEnv(job.Env)
+	}
+	if reason := xccmd.ClassifyFlags().LocalReason(); len(reason) > 0 {
+		d.Debug("not distributable: %s", reason)
+		return d.runLocal(job)
+	}
+	fingerprint, err := common.CompilerFingerprint(xccmd.GetCompiler(), xccmd.Environ())
+	if err != nil {
+		// without it a remote could build with a different compiler
+		d.Debug("not distributable: %s", err)
+		return d.runLocal(job)
+	}
+	if !xccmd.HasTarget() {
+		// the compiler would build for the machine it runs on, which may not be this one
+		xccmd.SetArch(runtime.GOARCH)
+	}
+	if job.ColorDiagnostics {
+		xccmd.SetColorDiagnostics()
+	}
+	// cache keys come from this, so replayed diagnostics are colored only when they were asked to be
+	origcmd := xccmd.Clone()
 
 	outputPath, err := xccmd.GetOutputFilepath()
 	if err != nil {
+		// the compiler picks a default output name we would have to guess at
+		d.Debug("not distributable: %s", err)
+		return d.runLocal(job)
+	}
+	if outputPath, err = xccmd.AbsPath(outputPath); err != nil {
 		d.Debug("failed to get output path: %s", err)
-		return err
+		return 0, err
 	}
 	startTime := time.Now()
 	stageTime := startTime
-	preprocessed, precmd, includeData, err := d.preprocessor.Preprocess(xccmd)
+	var directKey string
+	if d.cache != nil && d.cache.IsDirect() {
+		if directKey, err = d.cache.DirectKey(origcmd); err != nil {
+			d.Debug("failed to compute direct cache key: %s", err)
+		} else if resultKey, ok := d.cache.LookupDirect(directKey); ok &&
+			d.cache.Lookup(resultKey, true, job.stdout(), job.stderr()) {
+			d.Debug("direct cache hit: %s tdur: %v", outputPath, time.Since(startTime))
+			return 0, nil
+		}
+	}
+
+	// keep preprocessor diagnostics so cache hits can replay them
+	var prestderr bytes.Buffer
+	preprocessed, precmd, includeData, err := d.preprocessor.Preprocess(xccmd,
+		io.MultiWriter(job.stderr(), &prestderr))
 	if err != nil {
 		d.Debug("failed to preprocess: %s", err)
-		return err
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode(), nil
+		}
+		return 0, err
 	}
 	xccmd = precmd
 	d.Debug("preprocessing done: %s sz: %d sdur: %v tdur: %v", outputPath, len(preprocessed),
 		time.Since(stageTime), time.Since(startTime))
 
-	conn, err := d.getConn()
-	if err != nil {
-		d.Debug("failed to get runner connection: %s", err)
-		return err
+	var resultKey string
+	if d.cache != nil {
+		resultKey = d.cache.PreprocessedKey(origcmd, preprocessed, includeData)
+		if d.cache.Lookup(resultKey, false, job.stdout(), job.stderr()) {
+			d.Debug("cache hit: %s tdur: %v", outputPath, time.Since(startTime))
+			d.storeDirect(origcmd, directKey, resultKey, preprocessed, includeData)
+			return 0, nil
+		}
 	}
+
 	stageTime = time.Now()
+	wd := xccmd.GetDir()
+	if len(wd) == 0 {
+		if wd, err = os.Getwd(); err != nil {
+			return 0, err
+		}
+	}
+	compileCmd := common.CompileCmd{
+		Version:     common.ProtocolVersion,
+		Dir:         wd,
+		Compiler:    xccmd.GetCompiler(),
+		Fingerprint: fingerprint,
+		Args:        xccmd.GetTokens(),
+		Command:     xccmd.GetCommand(),
+		Env:         xccmd.GetEnv(),
+		Code:        preprocessed,
+	}
 	var cmdresp common.CompileResponse
-	if cmdresp, err = common.DoRPC[common.CompileCmd, common.CompileResponse](conn.Conn, common.MethodCompile,
-		common.CompileCmd{
-			Command:  xccmd.GetCommand(),
-			Code:     preprocessed,
-			Includes: includeData,
-		}, conn.Secret); err != nil {
-		d.Debug("failed to compile")
-		fmt.Fprint(os.Stderr, err.Error())
-		return err
-	}
-	d.Debug("compile done: %s sdur: %v tdur: %v", outputPath, time.Since(stageTime), time.Since(startTime))
+	query := RemoteQuery{
+		Target: xccmd.GetTarget(),
+	}
+	for attempt := 0; attempt <= d.opts.MaxRetries; attempt++ {
+		var remote Remote
+		if remote, err = d.remoteSelector.GetRemote(query); err != nil {
+			d.Debug("failed to get remote: %s", err)
+			break
+		}
+		query.Exclude = append(query.Exclude, remote.Address)
+		if cmdresp, err = d.compileRemote(remote, compileCmd, includeData); err == nil {
+			if err = checkOutputs(xccmd, cmdresp); err == nil {
+				break
+			}
+		}
+		d.Debug("failed to compile: remote: %s err: %s", remote.Address, err)
+		if !IsInfraError(err) {
+			break
+		}
+	}
+	if output, ok := compileFailure(err); ok {
+		// servers that predate ProtocolVersion send compiler failures as errors
+		io.WriteString(job.stderr(), output)
+		return 1, nil
+	}
+	if err != nil {
+		if d.opts.LocalFallback {
+			return d.runLocal(job)
+		}
+		return 0, err
+	}
+	d.Debug("compile done: %s exit: %d sdur: %v tdur: %v", outputPath, cmdresp.ExitCode,
+		time.Since(stageTime), time.Since(startTime))
+	if len(cmdresp.Stdout) == 0 && len(cmdresp.Stderr) == 0 {
+		// servers that predate ProtocolVersion only send combined output
+		cmdresp.Stderr = []byte(cmdresp.Output)
+	}
+	job.stdout().Write(cmdresp.Stdout)
+	job.stderr().Write(cmdresp.Stderr)
 
 	stageTime = time.Now()
-	// write dep file if one was specified
-	depPath, err := xccmd.GetDepFilepath()
-	if err == nil {
-		if err := common.WriteFileCreatePath(depPath, cmdresp.Dep); err != nil {
-			d.Debug("failed to write dep file: %s", err)
-			return err
-		}
+	// failed compiles can still write files, such as serialized diagnostics
+	written, err := d.writeOutputs(xccmd, outputPath, cmdresp)
+	if err != nil {
+		return 0, err
 	}
-	if err := common.WriteFileCreatePath(outputPath, cmdresp.Object); err != nil {
-		d.Debug("failed to write output file: %s", err)
-		return err
+	if cmdresp.ExitCode != 0 {
+		return cmdresp.ExitCode, nil
 	}
-	d.Debug("write done: %s sdur: %v tdur: %v", outputPath, time.Since(stageTime), time.Since(startTime))
-	return nil
+	d.Debug("write done: %s files: %d sdur: %v tdur: %v", outputPath, len(written), time.Since(stageTime),
+		time.Since(startTime))
+
+	if d.cache != nil {
+		if err := d.cache.Store(resultKey, d.outputPaths(origcmd, written), cmdresp.Stdout, cmdresp.Stderr,
+			prestderr.Bytes()); err != nil {
+			d.Debug("failed to store cache entry: %s", err)
+		}
+		d.storeDirect(origcmd, directKey, resultKey, preprocessed, includeData)
+	}
+	return 0, nil
 }
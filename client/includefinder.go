@@ -3,28 +3,44 @@ package client
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"mmaxim.org/xcdistcc/common"
 )
 
+type scannedFile struct {
+	size     int64
+	modTime  time.Time
+	includes []string
+}
+
 type IncludeFinder struct {
 	*common.LabelLogger
+
+	// the caches are shared by concurrent jobs when running inside the agent
+	cacheMu            sync.Mutex
 	directoryListCache map[string]map[string]bool
+	scanCache          map[string]scannedFile
 }
 
 func NewIncludeFinder(logger common.Logger) *IncludeFinder {
 	return &IncludeFinder{
 		LabelLogger:        common.NewLabelLogger("IncludeFinder", logger),
 		directoryListCache: make(map[string]map[string]bool),
+		scanCache:          make(map[string]scannedFile),
 	}
 }
 
 func (f *IncludeFinder) listDirectory(dir string) (map[string]bool, error) {
+	f.cacheMu.Lock()
 	dirlist, ok := f.directoryListCache[dir]
+	f.cacheMu.Unlock()
 	if ok {
 		return dirlist, nil
 	}
@@ -40,7 +56,9 @@ func (f *IncludeFinder) listDirectory(dir string) (map[string]bool, error) {
 	for _, name := range names {
 		ret[name] = true
 	}
+	f.cacheMu.Lock()
 	f.directoryListCache[dir] = ret
+	f.cacheMu.Unlock()
 	return ret, nil
 }
 
@@ -68,6 +86,27 @@ func (f *IncludeFinder) getIncludesFromFile(path string) (res []string, err erro
 		return nil, err
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f.cacheMu.Lock()
+	scanned, ok := f.scanCache[path]
+	f.cacheMu.Unlock()
+	if ok && scanned.size == info.Size() && scanned.modTime.Equal(info.ModTime()) {
+		return scanned.includes, nil
+	}
+	defer func() {
+		if err == nil {
+			f.cacheMu.Lock()
+			f.scanCache[path] = scannedFile{
+				size:     info.Size(),
+				modTime:  info.ModTime(),
+				includes: res,
+			}
+			f.cacheMu.Unlock()
+		}
+	}()
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		include, ok := f.includeFromLine(scanner.Text())
@@ -142,9 +181,9 @@ func (f *IncludeFinder) loadForcedIncludes(res map[string]common.IncludeData, in
 	}
 }
 
-func (f *IncludeFinder) Preprocess(cmd *common.XcodeCmd) (code []byte, retcmd *common.XcodeCmd, res []common.IncludeData, err error) {
+func (f *IncludeFinder) Preprocess(cmd *common.XcodeCmd, stderr io.Writer) (code []byte, retcmd *common.XcodeCmd, res []common.IncludeData, err error) {
 	retcmd = cmd.Clone()
-	dirs := cmd.IncludeDirs()
+	dirs := append(cmd.IncludeDirs(), cmd.EnvIncludeDirs()...)
 	for _, dir := range dirs {
 		f.Debug("include dir: %s", dir)
 	}
@@ -152,6 +191,9 @@ func (f *IncludeFinder) Preprocess(cmd *common.XcodeCmd) (code []byte, retcmd *c
 	if err != nil {
 		return nil, nil, nil, errors.Wrap(err, "failed to get input path")
 	}
+	if inputPath, err = cmd.AbsPath(inputPath); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to get input path")
+	}
 	if code, err = os.ReadFile(inputPath); err != nil {
 		return nil, nil, nil, errors.Wrap(err, "failed to read input file")
 	}
@@ -0,0 +1,389 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"mmaxim.org/xcdistcc/common"
+)
+
+type LocalCacheMode int
+
+const (
+	LocalCacheOff LocalCacheMode = iota
+	LocalCachePreprocessed
+	LocalCacheDirect
+)
+
+const maxManifestEntries = 16
+
+// cacheTrimInterval is how often the cache dir is checked against its max size. Every compile runs
+// in a new process, so the time of the last check is kept in a file in the dir.
+const cacheTrimInterval = time.Minute
+
+// cacheTrimRatio is the fraction of the max size a trim leaves the cache at, so the next stores do
+// not trim again right away.
+const cacheTrimRatio = 0.9
+
+type localCacheFile struct {
+	Path string
+	Data []byte
+}
+
+type localCacheEntry struct {
+	Files            []localCacheFile
+	Stdout           []byte
+	Stderr           []byte
+	PreprocessStderr []byte
+}
+
+type localCacheHeader struct {
+	Path   string
+	Digest string
+}
+
+type localCacheManifestEntry struct {
+	Headers   []localCacheHeader
+	ResultKey string
+}
+
+type localCacheManifest struct {
+	Entries []localCacheManifestEntry
+}
+
+// LocalCache stores compile outputs on disk. Results are keyed by the preprocessed code, and in
+// direct mode also by a manifest of the input file and the digests of every header it included,
+// which lets a hit skip preprocessing entirely. Once the files in the cache dir exceed maxSize
+// bytes, the least recently used ones are removed; a maxSize of 0 lets it grow without limit.
+type LocalCache struct {
+	*common.LabelLogger
+	dir     string
+	mode    LocalCacheMode
+	maxSize int64
+}
+
+func NewLocalCache(dir string, mode LocalCacheMode, maxSize int64, logger common.Logger) *LocalCache {
+	return &LocalCache{
+		LabelLogger: common.NewLabelLogger("LocalCache", logger),
+		dir:         dir,
+		mode:        mode,
+		maxSize:     maxSize,
+	}
+}
+
+func (c *LocalCache) IsDirect() bool {
+	return c.mode == LocalCacheDirect
+}
+
+func (c *LocalCache) path(key, ext string) string {
+	return filepath.Join(c.dir, key[:2], key+ext)
+}
+
+func (c *LocalCache) readMsgpack(path string, out any) error {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := msgpack.Unmarshal(dat, out); err != nil {
+		return err
+	}
+	// the modification time is when the file was last used, which is what trimming goes by
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return nil
+}
+
+func (c *LocalCache) writeMsgpack(path string, in any) error {
+	dat, err := msgpack.Marshal(in)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode cache file")
+	}
+	if err := common.WriteFileAtomic(path, dat); err != nil {
+		return err
+	}
+	c.maybeTrim()
+	return nil
+}
+
+// maybeTrim trims the cache if no process has checked its size within cacheTrimInterval.
+func (c *LocalCache) maybeTrim() {
+	if c.maxSize <= 0 {
+		return
+	}
+	stamp := filepath.Join(c.dir, "trimmed")
+	if info, err := os.Stat(stamp); err == nil && time.Since(info.ModTime()) < cacheTrimInterval {
+		return
+	}
+	if err := common.WriteFileCreatePath(stamp, nil); err != nil {
+		c.Debug("maybeTrim: failed to write trim time: %s", err)
+		return
+	}
+	if err := c.trim(); err != nil {
+		c.Debug("maybeTrim: failed to trim cache: %s", err)
+	}
+}
+
+type localCacheFileInfo struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// trim removes the least recently used cache files until they take up at most cacheTrimRatio of
+// the max size.
+func (c *LocalCache) trim() error {
+	var files []localCacheFileInfo
+	var total int64
+	err := filepath.WalkDir(c.dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			// files can disappear under concurrent trims
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		ext := filepath.Ext(path)
+		if entry.IsDir() || (ext != ".entry" && ext != ".manifest") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, localCacheFileInfo{
+			path:    path,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to list cache dir")
+	}
+	if total <= c.maxSize {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	target := int64(float64(c.maxSize) * cacheTrimRatio)
+	removed := 0
+	for _, file := range files {
+		if total <= target {
+			break
+		}
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		total -= file.size
+		removed++
+	}
+	c.Debug("trim: removed %d files, %d bytes left", removed, total)
+	return nil
+}
+
+func (c *LocalCache) commandDigest(cmd *common.XcodeCmd) *common.Digest {
+	d := common.NewDigest()
+	compiler := cmd.GetCompiler()
+	if fingerprint, err := common.CompilerFingerprint(compiler, cmd.Environ()); err == nil {
+		d.AddString(fingerprint)
+	} else {
+		d.AddString(common.CompilerIdentity(compiler))
+	}
+	// drivers that share a binary, like clang and clang++, still compile differently
+	d.AddString(cmd.GetDriver())
+	// relative paths in the command and its outputs are resolved against the working directory
+	d.AddString(cmd.GetDir())
+	d.AddStrings(cmd.GetNormalizedTokens())
+	cmd.AddEnvToDigest(d)
+	return d
+}
+
+// DirectKey returns the manifest key for cmd, which covers the command and the contents of the
+// input file.
+func (c *LocalCache) DirectKey(cmd *common.XcodeCmd) (string, error) {
+	inputPath, err := cmd.GetInputFilepath()
+	if err != nil {
+		return "", err
+	}
+	if inputPath, err = cmd.AbsPath(inputPath); err != nil {
+		return "", err
+	}
+	code, err := os.ReadFile(inputPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read input file")
+	}
+	d := c.commandDigest(cmd)
+	d.AddString("direct")
+	d.AddBytes(code)
+	return d.String(), nil
+}
+
+// PreprocessedKey returns the result key for cmd given the code and includes that the
+// preprocessor produced for it.
+func (c *LocalCache) PreprocessedKey(cmd *common.XcodeCmd, code []byte, includes []common.IncludeData) string {
+	d := c.commandDigest(cmd)
+	d.AddString("preprocessed")
+	d.AddBytes(code)
+	sorted := make([]common.IncludeData, len(includes))
+	copy(sorted, includes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+	d.AddCount(len(sorted))
+	for _, include := range sorted {
+		d.AddString(include.Path)
+		d.AddString(include.Data)
+	}
+	return d.String()
+}
+
+func (c *LocalCache) headersMatch(headers []localCacheHeader) bool {
+	for _, header := range headers {
+		dat, err := os.ReadFile(header.Path)
+		if err != nil {
+			return false
+		}
+		if common.DigestBytes(dat) != header.Digest {
+			return false
+		}
+	}
+	return true
+}
+
+// LookupDirect checks the manifest stored under directKey for an entry whose headers all still
+// match what is on disk, and returns its result key.
+func (c *LocalCache) LookupDirect(directKey string) (string, bool) {
+	var manifest localCacheManifest
+	if err := c.readMsgpack(c.path(directKey, ".manifest"), &manifest); err != nil {
+		return "", false
+	}
+	for _, entry := range manifest.Entries {
+		if c.headersMatch(entry.Headers) {
+			return entry.ResultKey, true
+		}
+	}
+	return "", false
+}
+
+// StoreDirect records that the input covered by directKey, when compiled with the given headers,
+// produced the result stored under resultKey.
+func (c *LocalCache) StoreDirect(directKey, resultKey string, headerPaths []string) error {
+	entry := localCacheManifestEntry{
+		ResultKey: resultKey,
+	}
+	for _, path := range headerPaths {
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to read header")
+		}
+		entry.Headers = append(entry.Headers, localCacheHeader{
+			Path:   path,
+			Digest: common.DigestBytes(dat),
+		})
+	}
+	path := c.path(directKey, ".manifest")
+	var manifest localCacheManifest
+	if err := c.readMsgpack(path, &manifest); err != nil && !os.IsNotExist(err) {
+		c.Debug("StoreDirect: discarding unreadable manifest: %s", err)
+	}
+	manifest.Entries = append([]localCacheManifestEntry{entry}, manifest.Entries...)
+	if len(manifest.Entries) > maxManifestEntries {
+		manifest.Entries = manifest.Entries[:maxManifestEntries]
+	}
+	return c.writeMsgpack(path, manifest)
+}
+
+// Lookup writes out the files stored under resultKey, and replays the compiler output that came
+// with them. Preprocessor diagnostics are only replayed if replayPreprocess is set. It returns
+// false if there are none.
+func (c *LocalCache) Lookup(resultKey string, replayPreprocess bool, stdout, stderr io.Writer) bool {
+	var entry localCacheEntry
+	if err := c.readMsgpack(c.path(resultKey, ".entry"), &entry); err != nil {
+		return false
+	}
+	for _, file := range entry.Files {
+		if err := common.WriteFileCreatePath(file.Path, file.Data); err != nil {
+			c.Debug("Lookup: failed to write cached file: %s", err)
+			return false
+		}
+	}
+	if replayPreprocess {
+		stderr.Write(entry.PreprocessStderr)
+	}
+	stdout.Write(entry.Stdout)
+	stderr.Write(entry.Stderr)
+	return true
+}
+
+// Store saves the current contents of paths under resultKey, along with the compiler output.
+func (c *LocalCache) Store(resultKey string, paths []string, stdout, stderr, preprocessStderr []byte) error {
+	entry := localCacheEntry{
+		Stdout:           stdout,
+		Stderr:           stderr,
+		PreprocessStderr: preprocessStderr,
+	}
+	for _, path := range paths {
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to read output file")
+		}
+		entry.Files = append(entry.Files, localCacheFile{
+			Path: path,
+			Data: dat,
+		})
+	}
+	return c.writeMsgpack(c.path(resultKey, ".entry"), entry)
+}
+
+// HeadersFromPreprocessed returns the files named by the line markers in preprocessor output.
+func HeadersFromPreprocessed(code []byte) (res []string, err error) {
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(code))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "# ") {
+			continue
+		}
+		toks := strings.SplitN(line[2:], " ", 2)
+		if len(toks) != 2 {
+			continue
+		}
+		if _, err := strconv.Atoi(toks[0]); err != nil {
+			continue
+		}
+		rest := toks[1]
+		if !strings.HasPrefix(rest, "\"") {
+			continue
+		}
+		end := strings.LastIndex(rest, "\"")
+		if end <= 0 {
+			continue
+		}
+		path, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			return nil, errors.Errorf("invalid line marker: %s", line)
+		}
+		if strings.HasPrefix(path, "<") || seen[path] {
+			continue
+		}
+		seen[path] = true
+		res = append(res, path)
+	}
+	// a partial header list would let stale results match, so treat scan failures as fatal
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to scan preprocessed code")
+	}
+	return res, nil
+}
@@ -38,10 +38,10 @@ func (c *RandRemoteSelector) getRandRemote(remotes []Remote) (res Remote, err er
 	return remote, nil
 }
 
-func (c *RandRemoteSelector) GetRemote() (Remote, error) {
-	return c.getRandRemote(c.remotes)
+func (c *RandRemoteSelector) GetRemote(query RemoteQuery) (Remote, error) {
+	return c.getRandRemote(query.filter(c.remotes))
 }
 
-func (c *RandRemoteSelector) GetRemoteWithPreprocessor() (Remote, error) {
-	return c.getRandRemote(c.preprocessorRemotes)
+func (c *RandRemoteSelector) GetRemoteWithPreprocessor(query RemoteQuery) (Remote, error) {
+	return c.getRandRemote(query.filter(c.preprocessorRemotes))
 }
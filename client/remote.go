@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"net"
 
 	"mmaxim.org/xcdistcc/common"
@@ -17,6 +18,10 @@ type Remote struct {
 	Address   string
 	PublicKey *common.PublicKey
 	Powers    []Power
+	// Identity is the client key pair to authenticate with, if any.
+	Identity *common.KeyPair
+	// TLS, if set, connects with TLS instead of the key pair handshake.
+	TLS *tls.Config
 }
 
 func (r Remote) HasPower(target Power) bool {
@@ -29,18 +34,23 @@ func (r Remote) HasPower(target Power) bool {
 }
 
 type RemoteConn struct {
-	Conn   net.Conn
-	Secret *common.SharedSecret
+	*common.MuxConn
 }
 
-func NewRemoteConn(conn net.Conn, secret *common.SharedSecret) *RemoteConn {
+func NewRemoteConn(conn net.Conn, session *common.Session) *RemoteConn {
 	return &RemoteConn{
-		Conn:   conn,
-		Secret: secret,
+		MuxConn: common.NewMuxConn(conn, session),
 	}
 }
 
 func DialRemote(remote Remote) (*RemoteConn, error) {
+	if remote.TLS != nil {
+		conn, err := common.DialTLS(remote.Address, remote.TLS)
+		if err != nil {
+			return nil, err
+		}
+		return NewRemoteConn(conn, nil), nil
+	}
 	if remote.PublicKey == nil {
 		conn, err := net.Dial("tcp", remote.Address)
 		if err != nil {
@@ -48,9 +58,9 @@ func DialRemote(remote Remote) (*RemoteConn, error) {
 		}
 		return NewRemoteConn(conn, nil), err
 	}
-	conn, secret, err := common.DialEncrypted(remote.Address, *remote.PublicKey)
+	conn, session, err := common.DialEncrypted(remote.Address, *remote.PublicKey, remote.Identity)
 	if err != nil {
 		return nil, err
 	}
-	return NewRemoteConn(conn, secret), nil
+	return NewRemoteConn(conn, session), nil
 }
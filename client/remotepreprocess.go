@@ -1,6 +1,7 @@
 package client
 
 import (
+	"io"
 	"os"
 
 	"mmaxim.org/xcdistcc/common"
@@ -10,59 +11,78 @@ type RemotePreprocessor struct {
 	*common.LabelLogger
 	remoteSelector RemoteSelector
 	backup         Preprocessor
+	connPool       *ConnPool
 }
 
-func NewRemotePreprocessor(remoteSelector RemoteSelector, backup Preprocessor, logger common.Logger) *RemotePreprocessor {
+func NewRemotePreprocessor(remoteSelector RemoteSelector, backup Preprocessor, connPool *ConnPool,
+	logger common.Logger) *RemotePreprocessor {
 	return &RemotePreprocessor{
 		LabelLogger:    common.NewLabelLogger("RemotePreprocessor", logger),
 		remoteSelector: remoteSelector,
 		backup:         backup,
+		connPool:       connPool,
 	}
 }
 
-func (p *RemotePreprocessor) getConn() (*RemoteConn, error) {
-	remote, err := p.remoteSelector.GetRemoteWithPreprocessor()
+func (p *RemotePreprocessor) getConn(target common.Target) (*RemoteConn, error) {
+	remote, err := p.remoteSelector.GetRemoteWithPreprocessor(RemoteQuery{
+		Target: target,
+	})
 	if err != nil {
 		return nil, err
 	}
-	return DialRemote(remote)
+	return p.connPool.Get(remote)
 }
 
-func (p *RemotePreprocessor) Preprocess(cmd *common.XcodeCmd) (res []byte, retcmd *common.XcodeCmd, includes []common.IncludeData, err error) {
+func (p *RemotePreprocessor) Preprocess(cmd *common.XcodeCmd, stderr io.Writer) (res []byte, retcmd *common.XcodeCmd, includes []common.IncludeData, err error) {
 	defer func() {
 		if err != nil {
 			p.Debug("failed to get remote conn, using backup: %s", err)
-			res, retcmd, includes, err = p.backup.Preprocess(cmd)
+			res, retcmd, includes, err = p.backup.Preprocess(cmd, stderr)
 		}
 	}()
 
-	conn, err := p.getConn()
+	conn, err := p.getConn(cmd.GetTarget())
 	if err != nil {
 		return res, retcmd, includes, err
 	}
-	wd, err := os.Getwd()
+	wd := cmd.GetDir()
+	if len(wd) == 0 {
+		if wd, err = os.Getwd(); err != nil {
+			return res, retcmd, includes, err
+		}
+	}
+
+	fingerprint, err := common.CompilerFingerprint(cmd.GetCompiler(), cmd.Environ())
 	if err != nil {
 		return res, retcmd, includes, err
 	}
-
 	var cmdresp common.PreprocessResponse
-	if cmdresp, err = common.DoRPC[common.PreprocessCmd, common.PreprocessResponse](conn.Conn,
+	if cmdresp, err = common.DoRPC[common.PreprocessCmd, common.PreprocessResponse](conn,
 		common.MethodPreprocess,
 		common.PreprocessCmd{
-			Dir:     wd,
-			Command: cmd.GetCommand(),
-		}, conn.Secret); err != nil {
+			Dir:         wd,
+			Compiler:    cmd.GetCompiler(),
+			Fingerprint: fingerprint,
+			Args:        cmd.GetTokens(),
+			Command:     cmd.GetCommand(),
+			Env:         cmd.GetEnv(),
+		}); err != nil {
 		return res, retcmd, includes, err
 	}
 	depPath, err := cmd.GetDepFilepath()
 	if err == nil {
+		if depPath, err = cmd.AbsPath(depPath); err != nil {
+			return res, retcmd, includes, err
+		}
 		if err := common.WriteFileCreatePath(depPath, cmdresp.Dep); err != nil {
 			p.Debug("failed to write dep file: %s", err)
 			return res, retcmd, includes, err
 		}
 	}
+	io.WriteString(stderr, cmdresp.Output)
 	retcmd = cmd.Clone()
-	retcmd.RemoveDepFilepath()
+	retcmd.RemoveDepFlags()
 
 	return cmdresp.Code, retcmd, nil, nil
 }
@@ -3,18 +3,33 @@ package client
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 	"mmaxim.org/xcdistcc/common"
 )
 
+type cachedStatus struct {
+	status common.StatusResponse
+	err    error
+	time   time.Time
+	// jobs sent to the remote since status was fetched
+	assigned int
+}
+
 type StatusRemoteSelector struct {
 	*common.LabelLogger
 	remotes             []Remote
 	preprocessorRemotes []Remote
+	connPool            *ConnPool
+	statusTTL           time.Duration
+
+	statusCacheMu sync.Mutex
+	statusCache   map[string]*cachedStatus
 }
 
-func NewStatusRemoteSelector(remotes []Remote, logger common.Logger) *StatusRemoteSelector {
+func NewStatusRemoteSelector(remotes []Remote, connPool *ConnPool, statusTTL time.Duration,
+	logger common.Logger) *StatusRemoteSelector {
 	var prs []Remote
 	for _, remote := range remotes {
 		if remote.HasPower(PreprocessorPower) {
@@ -25,35 +40,76 @@ func NewStatusRemoteSelector(remotes []Remote, logger common.Logger) *StatusRemo
 		LabelLogger:         common.NewLabelLogger("StatusRemoteSelector", logger),
 		remotes:             remotes,
 		preprocessorRemotes: prs,
+		connPool:            connPool,
+		statusTTL:           statusTTL,
+		statusCache:         make(map[string]*cachedStatus),
 	}
 }
 
-func (s *StatusRemoteSelector) getRemoteStatus(remote Remote) (res common.StatusResponse, err error) {
-	conn, err := DialRemote(remote)
+func (s *StatusRemoteSelector) fetchRemoteStatus(remote Remote) (res common.StatusResponse, err error) {
+	conn, err := s.connPool.Get(remote)
 	if err != nil {
 		return res, err
 	}
-	return common.DoRPC[common.StatusCmd, common.StatusResponse](conn.Conn, common.MethodStatus,
-		common.StatusCmd{}, conn.Secret)
+	return common.DoRPC[common.StatusCmd, common.StatusResponse](conn, common.MethodStatus,
+		common.StatusCmd{})
+}
+
+// getRemoteStatus returns the status of remote, reusing a fetched status for up to statusTTL. The
+// returned assigned count is the number of jobs handed to the remote since then.
+func (s *StatusRemoteSelector) getRemoteStatus(remote Remote) (res common.StatusResponse, assigned int, err error) {
+	s.statusCacheMu.Lock()
+	cached, ok := s.statusCache[remote.Address]
+	s.statusCacheMu.Unlock()
+	if ok && time.Since(cached.time) < s.statusTTL {
+		return cached.status, cached.assigned, cached.err
+	}
+	res, err = s.fetchRemoteStatus(remote)
+	s.statusCacheMu.Lock()
+	s.statusCache[remote.Address] = &cachedStatus{
+		status: res,
+		err:    err,
+		time:   time.Now(),
+	}
+	s.statusCacheMu.Unlock()
+	return res, 0, err
+}
+
+func (s *StatusRemoteSelector) markAssigned(remote Remote) {
+	s.statusCacheMu.Lock()
+	defer s.statusCacheMu.Unlock()
+	if cached, ok := s.statusCache[remote.Address]; ok {
+		cached.assigned++
+	}
 }
 
 type remoteScore struct {
 	score  int
 	remote Remote
+	// unsupported is set for remotes that said they can not build the job's target
+	unsupported bool
 }
 
-func (s *StatusRemoteSelector) bestRemote(remoteScores []remoteScore) (res Remote) {
+func (s *StatusRemoteSelector) bestRemote(remoteScores []remoteScore) (res Remote, err error) {
 	bestScore := -1
+	found := false
 	for _, rs := range remoteScores {
-		if bestScore < 0 || (rs.score >= 0 && rs.score < bestScore) {
+		if rs.unsupported {
+			continue
+		}
+		if !found || bestScore < 0 || (rs.score >= 0 && rs.score < bestScore) {
 			res = rs.remote
 			bestScore = rs.score
+			found = true
 		}
 	}
-	return res
+	if !found {
+		return res, errors.New("no remotes build for the target")
+	}
+	return res, nil
 }
 
-func (s *StatusRemoteSelector) getBestRemote(remotes []Remote) (res Remote, err error) {
+func (s *StatusRemoteSelector) getBestRemote(remotes []Remote, target common.Target) (res Remote, err error) {
 	if len(remotes) == 0 {
 		return res, errors.New("no remotes available")
 	}
@@ -64,17 +120,22 @@ func (s *StatusRemoteSelector) getBestRemote(remotes []Remote) (res Remote, err
 		remote := lremote
 		index := lindex
 		eg.Go(func() error {
-			status, err := s.getRemoteStatus(remote)
+			status, assigned, err := s.getRemoteStatus(remote)
 			score := -1
+			unsupported := false
 			if err != nil {
 				s.Debug("GetRemote: failed to get status: %s", err)
+			} else if !status.Supports(target) {
+				s.Debug("GetRemote: %s does not build for target: %s", remote.Address, target)
+				unsupported = true
 			} else {
-				score = len(status.QueuedJobs)
+				score = len(status.QueuedJobs) + assigned
 			}
 			scoresMu.Lock()
 			scores[index] = remoteScore{
-				score:  score,
-				remote: remote,
+				score:       score,
+				remote:      remote,
+				unsupported: unsupported,
 			}
 			scoresMu.Unlock()
 			return nil
@@ -83,13 +144,17 @@ func (s *StatusRemoteSelector) getBestRemote(remotes []Remote) (res Remote, err
 	if err := eg.Wait(); err != nil {
 		return res, err
 	}
-	return s.bestRemote(scores), nil
+	if res, err = s.bestRemote(scores); err != nil {
+		return res, err
+	}
+	s.markAssigned(res)
+	return res, nil
 }
 
-func (s *StatusRemoteSelector) GetRemote() (res Remote, err error) {
-	return s.getBestRemote(s.remotes)
+func (s *StatusRemoteSelector) GetRemote(query RemoteQuery) (res Remote, err error) {
+	return s.getBestRemote(query.filter(s.remotes), query.Target)
 }
 
-func (s *StatusRemoteSelector) GetRemoteWithPreprocessor() (res Remote, err error) {
-	return s.getBestRemote(s.preprocessorRemotes)
+func (s *StatusRemoteSelector) GetRemoteWithPreprocessor(query RemoteQuery) (res Remote, err error) {
+	return s.getBestRemote(query.filter(s.preprocessorRemotes), query.Target)
 }
@@ -46,13 +46,38 @@ func RandString(prefix string, numbytes int) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	str := base32.StdEncoding.EncodeToString(buf)
+	// no padding, since '=' has special meaning in flags like -ffile-prefix-map
+	str := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
 	if prefix != "" {
 		str = strings.Join([]string{prefix, str}, "")
 	}
 	return str, nil
 }
 
+// WriteFileAtomic writes dat to fullpath through a temp file in the same directory that is renamed
+// into place, so concurrent readers never see a partial file.
+func WriteFileAtomic(fullpath string, dat []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+		return errors.Wrap(err, "failed to make directory")
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fullpath), "tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(dat); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to close file")
+	}
+	if err := os.Rename(tmp.Name(), fullpath); err != nil {
+		return errors.Wrap(err, "failed to rename file")
+	}
+	return nil
+}
+
 func WriteFileCreatePath(fullpath string, dat []byte) error {
 	if err := os.MkdirAll(filepath.Dir(fullpath), 0644); err != nil {
 		return errors.Wrap(err, "failed to make directory")
@@ -1,15 +1,11 @@
 package common
 
 import (
-	"bytes"
-	"crypto/rand"
 	"encoding/hex"
 	"fmt"
-	"io"
 	"net"
 
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/nacl/box"
 )
 
 type PrivateKey [32]byte
@@ -109,20 +105,17 @@ func (s SharedSecret) String() string {
 	return hex.EncodeToString(s[:])
 }
 
-func DialEncrypted(address string, remotePublicKey PublicKey) (net.Conn, *SharedSecret, error) {
+// DialEncrypted connects to address and runs the handshake with the server, authenticating as
+// identity if it is not nil.
+func DialEncrypted(address string, remotePublicKey PublicKey, identity *KeyPair) (net.Conn, *Session, error) {
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		return nil, nil, err
 	}
-	public, private, err := box.GenerateKey(rand.Reader)
+	session, err := ClientHandshake(conn, remotePublicKey, identity)
 	if err != nil {
-		return nil, nil, err
-	}
-	if _, err := io.Copy(conn, bytes.NewBuffer(public[:])); err != nil {
-		return nil, nil, err
+		conn.Close()
+		return nil, nil, errors.Wrapf(err, "handshake with %s failed", address)
 	}
-	var out [32]byte
-	box.Precompute(&out, remotePublicKey.RawPtr(), private)
-	secret := NewSharedSecret(out)
-	return conn, &secret, nil
+	return conn, session, nil
 }
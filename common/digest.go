@@ -0,0 +1,63 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+)
+
+// Digest builds a SHA-256 over a sequence of length-prefixed fields, so that different field
+// boundaries never produce the same digest.
+type Digest struct {
+	h hash.Hash
+}
+
+func NewDigest() *Digest {
+	return &Digest{
+		h: sha256.New(),
+	}
+}
+
+func (d *Digest) AddCount(count int) {
+	var sz [8]byte
+	binary.BigEndian.PutUint64(sz[:], uint64(count))
+	d.h.Write(sz[:])
+}
+
+func (d *Digest) AddBytes(dat []byte) {
+	d.AddCount(len(dat))
+	d.h.Write(dat)
+}
+
+func (d *Digest) AddString(str string) {
+	d.AddBytes([]byte(str))
+}
+
+func (d *Digest) AddStrings(strs []string) {
+	d.AddCount(len(strs))
+	for _, str := range strs {
+		d.AddString(str)
+	}
+}
+
+func (d *Digest) String() string {
+	return hex.EncodeToString(d.h.Sum(nil))
+}
+
+func DigestBytes(dat []byte) string {
+	sum := sha256.Sum256(dat)
+	return hex.EncodeToString(sum[:])
+}
+
+// CompilerIdentity returns a string that changes whenever the compiler binary at path is replaced,
+// so cached results from an old compiler are never served for a new one.
+func CompilerIdentity(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return path
+	}
+	return fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano())
+}
@@ -0,0 +1,122 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CompilerEnvVars are the environment variables that change what the compiler does, which jobs
+// carry to wherever they run.
+var CompilerEnvVars = []string{
+	"SDKROOT",
+	"DEVELOPER_DIR",
+	"MACOSX_DEPLOYMENT_TARGET",
+	"IPHONEOS_DEPLOYMENT_TARGET",
+	"TVOS_DEPLOYMENT_TARGET",
+	"WATCHOS_DEPLOYMENT_TARGET",
+	"XROS_DEPLOYMENT_TARGET",
+	"CPATH",
+	"C_INCLUDE_PATH",
+	"CPLUS_INCLUDE_PATH",
+	"OBJC_INCLUDE_PATH",
+	"SOURCE_DATE_EPOCH",
+}
+
+// IncludePathEnvVars are the compiler environment variables that hold lists of include dirs.
+var IncludePathEnvVars = []string{
+	"CPATH",
+	"C_INCLUDE_PATH",
+	"CPLUS_INCLUDE_PATH",
+	"OBJC_INCLUDE_PATH",
+}
+
+func isCompilerEnvVar(name string) bool {
+	return containsString(CompilerEnvVars, name)
+}
+
+// CompilerEnv returns the compiler environment variables set in environ, which is in the form of
+// os.Environ.
+func CompilerEnv(environ []string) map[string]string {
+	res := make(map[string]string)
+	for _, kv := range environ {
+		if name, value, ok := strings.Cut(kv, "="); ok && isCompilerEnvVar(name) {
+			res[name] = value
+		}
+	}
+	return res
+}
+
+// MergeCompilerEnv returns base, in the form of os.Environ, with its compiler environment
+// variables replaced by env.
+func MergeCompilerEnv(base []string, env map[string]string) (res []string) {
+	for _, kv := range base {
+		if name, _, _ := strings.Cut(kv, "="); !isCompilerEnvVar(name) {
+			res = append(res, kv)
+		}
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		if isCompilerEnvVar(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res = append(res, name+"="+env[name])
+	}
+	return res
+}
+
+// SetEnv sets the compiler environment the command runs with. A nil env runs it with the
+// environment of this process.
+func (c *XcodeCmd) SetEnv(env map[string]string) {
+	c.env = env
+}
+
+func (c *XcodeCmd) GetEnv() map[string]string {
+	return c.env
+}
+
+// Environ returns the environment to run the command's compiler with, nil for the environment of
+// this process.
+func (c *XcodeCmd) Environ() []string {
+	if c.env == nil {
+		return nil
+	}
+	return MergeCompilerEnv(os.Environ(), c.env)
+}
+
+// EnvIncludeDirs returns the include dirs the command gets from the include path variables of its
+// environment.
+func (c *XcodeCmd) EnvIncludeDirs() (res []string) {
+	env := c.env
+	if env == nil {
+		env = CompilerEnv(os.Environ())
+	}
+	for _, name := range IncludePathEnvVars {
+		for _, dir := range filepath.SplitList(env[name]) {
+			// empty entries are the working directory
+			if abspath, err := c.AbsPath(dir); err == nil {
+				res = append(res, abspath)
+			}
+		}
+	}
+	return res
+}
+
+// AddEnvToDigest adds the compiler environment of the command to d.
+func (c *XcodeCmd) AddEnvToDigest(d *Digest) {
+	env := c.env
+	if env == nil {
+		env = CompilerEnv(os.Environ())
+	}
+	var vars []string
+	for _, name := range CompilerEnvVars {
+		if value, ok := env[name]; ok {
+			vars = append(vars, name+"="+value)
+		}
+	}
+	d.AddStrings(vars)
+}
@@ -0,0 +1,230 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const compilerOutputTimeout = 10 * time.Second
+
+// fingerprintFormat changes whenever fingerprints are computed differently, so ones cached on disk
+// by older versions are not used
+const fingerprintFormat = "2"
+
+type fingerprintEntry struct {
+	identity    string
+	fingerprint string
+}
+
+var fingerprintMu sync.Mutex
+var fingerprints = make(map[string]fingerprintEntry)
+
+// CompilerOutput runs the compiler at path with args and returns its stdout, giving up on compilers
+// that hang.
+func CompilerOutput(path string, args ...string) ([]byte, error) {
+	return commandOutput(nil, path, args...)
+}
+
+// commandOutput is CompilerOutput with the environment in the form of os.Environ, nil for the
+// environment of this process.
+func commandOutput(environ []string, path string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), compilerOutputTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = environ
+	return cmd.Output()
+}
+
+// xcrunShims is set where the compilers in xcrunShimDir are trampolines that run the compiler of
+// the selected Xcode, which xcrun finds.
+var xcrunShims = runtime.GOOS == "darwin"
+
+const xcrunShimDir = "/usr/bin"
+const xcrunPath = "/usr/bin/xcrun"
+
+// xcodeSelectLink is where xcode-select keeps the Xcode it selected.
+const xcodeSelectLink = "/var/db/xcode_select_link"
+
+var xcrunCompilers = make(map[string]string)
+
+// selectedDeveloperDir returns what decides the Xcode xcrun picks: DEVELOPER_DIR from environ, or
+// the one chosen with xcode-select.
+func selectedDeveloperDir(environ []string) string {
+	if environ == nil {
+		environ = os.Environ()
+	}
+	for _, kv := range environ {
+		if name, value, ok := strings.Cut(kv, "="); ok && name == "DEVELOPER_DIR" {
+			return value
+		}
+	}
+	link, _ := os.Readlink(xcodeSelectLink)
+	return link
+}
+
+// realCompiler returns the compiler that running path with environ runs, and the developer dir
+// that decided it, empty if path is not a trampoline.
+func realCompiler(path string, environ []string) (real, developerDir string) {
+	name := filepath.Base(path)
+	if !xcrunShims || filepath.Dir(path) != xcrunShimDir || !IsCompilerDriver(name) {
+		return path, ""
+	}
+	developerDir = selectedDeveloperDir(environ)
+	key := name + "\x00" + developerDir
+	fingerprintMu.Lock()
+	real, ok := xcrunCompilers[key]
+	fingerprintMu.Unlock()
+	if ok {
+		return real, developerDir
+	}
+	out, err := commandOutput(environ, xcrunPath, "--find", name)
+	if real = strings.TrimSpace(string(out)); err != nil || !filepath.IsAbs(real) {
+		// fingerprint the trampoline, which no server will match
+		return path, developerDir
+	}
+	fingerprintMu.Lock()
+	defer fingerprintMu.Unlock()
+	xcrunCompilers[key] = real
+	return real, developerDir
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprintCachePath returns the file the fingerprint of the compiler with identity is kept in
+// across processes, empty if there is no home dir.
+func fingerprintCachePath(identity string) string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	d := NewDigest()
+	d.AddString(fingerprintFormat)
+	d.AddString(identity)
+	return filepath.Join(homeDir, ".xcdistcc", "fingerprints", d.String())
+}
+
+func readFingerprintCache(identity string) (string, bool) {
+	path := fingerprintCachePath(identity)
+	if len(path) == 0 {
+		return "", false
+	}
+	dat, err := os.ReadFile(path)
+	if err != nil || len(dat) == 0 {
+		return "", false
+	}
+	return string(dat), true
+}
+
+func writeFingerprintCache(identity, fingerprint string) error {
+	path := fingerprintCachePath(identity)
+	if len(path) == 0 {
+		return nil
+	}
+	return WriteFileAtomic(path, []byte(fingerprint))
+}
+
+// installIndependentVersion returns the --version output of a compiler without the lines that
+// name where it is installed.
+func installIndependentVersion(version string) string {
+	var lines []string
+	for _, line := range strings.Split(version, "\n") {
+		if !strings.HasPrefix(line, "InstalledDir:") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// installIndependentResourceDir returns the resource dir of the compiler binary at real relative
+// to the binary, which is where clang looks for it.
+func installIndependentResourceDir(real, resourceDir string) string {
+	if len(resourceDir) == 0 {
+		return ""
+	}
+	if rel, err := filepath.Rel(filepath.Dir(real), resourceDir); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.Base(resourceDir)
+}
+
+// CompilerFingerprint returns a digest of what decides the objects the compiler at path produces:
+// its --version output, the hash of its binary, and its resource dir with the builtin headers.
+// Drivers that link to the same binary get the same fingerprint, and so do copies of the compiler
+// installed in different places. Trampolines like /usr/bin/clang on macOS are fingerprinted as the
+// compiler they run with environ, which is in the form of os.Environ, nil for the environment of
+// this process. Fingerprints are remembered, also on disk, until the binary is replaced.
+func CompilerFingerprint(path string, environ []string) (string, error) {
+	// bare names like clang run the compiler on PATH
+	if resolved, err := exec.LookPath(path); err == nil {
+		path = resolved
+	}
+	path, developerDir := realCompiler(path, environ)
+	identity := CompilerIdentity(path) + ":" + developerDir
+	fingerprintMu.Lock()
+	entry, ok := fingerprints[path]
+	fingerprintMu.Unlock()
+	if ok && entry.identity == identity {
+		return entry.fingerprint, nil
+	}
+	fingerprint, ok := readFingerprintCache(identity)
+	if !ok {
+		var err error
+		if fingerprint, err = computeCompilerFingerprint(path); err != nil {
+			return "", err
+		}
+		// failing to cache only costs running the compiler again
+		writeFingerprintCache(identity, fingerprint)
+	}
+
+	fingerprintMu.Lock()
+	defer fingerprintMu.Unlock()
+	fingerprints[path] = fingerprintEntry{
+		identity:    identity,
+		fingerprint: fingerprint,
+	}
+	return fingerprint, nil
+}
+
+func computeCompilerFingerprint(path string) (string, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to resolve compiler")
+	}
+	binaryHash, err := hashFile(real)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to hash compiler")
+	}
+	version, err := CompilerOutput(path, "--version")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get compiler version")
+	}
+	// not every compiler has a resource dir
+	resourceDir, _ := CompilerOutput(path, "-print-resource-dir")
+	d := NewDigest()
+	d.AddString(installIndependentVersion(string(version)))
+	d.AddString(binaryHash)
+	d.AddString(installIndependentResourceDir(real, strings.TrimSpace(string(resourceDir))))
+	return d.String(), nil
+}
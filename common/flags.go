@@ -0,0 +1,637 @@
+package common
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// FlagKind describes what part of a compile a compiler flag affects.
+type FlagKind int
+
+const (
+	// FlagUnknown is any flag not in the table. Since we cannot tell whether it takes a value,
+	// commands with unknown flags are run locally.
+	FlagUnknown FlagKind = iota
+	// FlagPreprocessor flags only affect preprocessing, such as macros and header search paths.
+	FlagPreprocessor
+	// FlagCompile flags affect compiling the preprocessed code, or both stages.
+	FlagCompile
+	// FlagMode flags select what the driver does, such as -c or -E.
+	FlagMode
+	// FlagLocalOnly flags read or write state on the local machine beyond the input and outputs we
+	// know how to ship, so commands with them are run locally.
+	FlagLocalOnly
+	// FlagLink flags only make sense when linking, which is always done locally.
+	FlagLink
+)
+
+func (k FlagKind) String() string {
+	switch k {
+	case FlagPreprocessor:
+		return "preprocessor"
+	case FlagCompile:
+		return "compile"
+	case FlagMode:
+		return "mode"
+	case FlagLocalOnly:
+		return "local-only"
+	case FlagLink:
+		return "link"
+	default:
+		return "unknown"
+	}
+}
+
+type flagForm int
+
+const (
+	// flagNoValue matches the name exactly and takes no value
+	flagNoValue flagForm = iota
+	// flagSeparate matches the name exactly and takes the next token as its value
+	flagSeparate
+	// flagJoined matches any token starting with the name, with the value in the same token
+	flagJoined
+	// flagJoinedOrSeparate is flagJoined, or flagSeparate if the token is exactly the name
+	flagJoinedOrSeparate
+)
+
+type flagSpec struct {
+	name string
+	kind FlagKind
+	form flagForm
+}
+
+// flagTable lists the clang driver flags we understand. Flags that XcodeCmd rewrites, such as -o,
+// -MF and -arch, are only listed in their separate form, so joined spellings are treated as
+// unknown rather than silently missed.
+var flagTable = []flagSpec{
+	// modes
+	{"-c", FlagMode, flagNoValue},
+	{"-E", FlagMode, flagNoValue},
+	{"-S", FlagMode, flagNoValue},
+	{"-M", FlagMode, flagNoValue},
+	{"-MM", FlagMode, flagNoValue},
+	{"-fsyntax-only", FlagMode, flagNoValue},
+	{"-emit-llvm", FlagMode, flagNoValue},
+	{"-###", FlagMode, flagNoValue},
+	{"-v", FlagMode, flagNoValue},
+	{"--version", FlagMode, flagNoValue},
+	{"-help", FlagMode, flagNoValue},
+	{"--help", FlagMode, flagNoValue},
+	{"-print-", FlagMode, flagJoined},
+	{"--print-", FlagMode, flagJoined},
+
+	// preprocessor
+	{"-D", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-U", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-I", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-F", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-isystem", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-iquote", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-idirafter", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-iframework", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-iframeworkwithsysroot", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-iprefix", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-iwithprefix", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-iwithprefixbefore", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-iwithsysroot", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-include", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-imacros", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-ivfsoverlay", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-I-", FlagPreprocessor, flagNoValue},
+	{"-nostdinc", FlagPreprocessor, flagNoValue},
+	{"-nostdinc++", FlagPreprocessor, flagNoValue},
+	{"-nostdlibinc", FlagPreprocessor, flagNoValue},
+	{"-nobuiltininc", FlagPreprocessor, flagNoValue},
+	{"-undef", FlagPreprocessor, flagNoValue},
+	{"-C", FlagPreprocessor, flagNoValue},
+	{"-CC", FlagPreprocessor, flagNoValue},
+	{"-P", FlagPreprocessor, flagNoValue},
+	{"-H", FlagPreprocessor, flagNoValue},
+	{"-MD", FlagPreprocessor, flagNoValue},
+	{"-MMD", FlagPreprocessor, flagNoValue},
+	{"-MP", FlagPreprocessor, flagNoValue},
+	{"-MG", FlagPreprocessor, flagNoValue},
+	{"-MV", FlagPreprocessor, flagNoValue},
+	{"-MF", FlagPreprocessor, flagSeparate},
+	{"-MT", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-MQ", FlagPreprocessor, flagJoinedOrSeparate},
+	{"-Wp,", FlagPreprocessor, flagJoined},
+	{"-Xpreprocessor", FlagPreprocessor, flagSeparate},
+	{"-fmodule-map-file=", FlagPreprocessor, flagJoined},
+
+	// compile
+	{"-o", FlagCompile, flagSeparate},
+	{"-arch", FlagCompile, flagSeparate},
+	{"-x", FlagCompile, flagJoinedOrSeparate},
+	{"-target", FlagCompile, flagSeparate},
+	{"--target=", FlagCompile, flagJoined},
+	{"-isysroot", FlagCompile, flagJoinedOrSeparate},
+	{"--sysroot", FlagCompile, flagSeparate},
+	{"--sysroot=", FlagCompile, flagJoined},
+	{"-std=", FlagCompile, flagJoined},
+	{"-stdlib=", FlagCompile, flagJoined},
+	{"-ansi", FlagCompile, flagNoValue},
+	{"-O", FlagCompile, flagJoined},
+	{"-g", FlagCompile, flagJoined},
+	{"-W", FlagCompile, flagJoined},
+	{"-w", FlagCompile, flagNoValue},
+	{"-pedantic", FlagCompile, flagNoValue},
+	{"-pedantic-errors", FlagCompile, flagNoValue},
+	{"-f", FlagCompile, flagJoined},
+	{"-m", FlagCompile, flagJoined},
+	{"-pipe", FlagCompile, flagNoValue},
+	{"-pthread", FlagCompile, flagNoValue},
+	{"-Xclang", FlagCompile, flagSeparate},
+	{"-Xassembler", FlagCompile, flagSeparate},
+	{"-Wa,", FlagCompile, flagJoined},
+	// these write files besides the object. They used to run locally, and are distributable now
+	// that the server returns every file the compiler writes and the client only writes back the
+	// ones AllowsOutput accepts.
+	{"-index-store-path", FlagCompile, flagSeparate},
+	{"-index-unit-output-path", FlagCompile, flagSeparate},
+	{"-serialize-diagnostics", FlagCompile, flagSeparate},
+	{"--serialize-diagnostics", FlagCompile, flagSeparate},
+	{"-save-temps", FlagCompile, flagJoined},
+	{"-ftime-trace", FlagCompile, flagJoined},
+	{"-ftime-trace=", FlagCompile, flagJoined},
+	{"-gsplit-dwarf", FlagCompile, flagJoined},
+	{"-MJ", FlagCompile, flagJoinedOrSeparate},
+	{"-foptimization-record-file=", FlagCompile, flagJoined},
+	{"-fproc-stat-report=", FlagCompile, flagJoined},
+
+	// local only
+	// these read files on this machine, which the -f catch-all would send to servers without
+	{"-fprofile-use=", FlagLocalOnly, flagJoined},
+	{"-fprofile-instr-use=", FlagLocalOnly, flagJoined},
+	{"-fprofile-sample-use=", FlagLocalOnly, flagJoined},
+	{"-fprofile-list=", FlagLocalOnly, flagJoined},
+	{"-fprofile-remapping-file=", FlagLocalOnly, flagJoined},
+	{"-fsanitize-ignorelist=", FlagLocalOnly, flagJoined},
+	{"-fsanitize-blacklist=", FlagLocalOnly, flagJoined},
+	{"-fsanitize-system-ignorelist=", FlagLocalOnly, flagJoined},
+	{"-fsanitize-coverage-allowlist=", FlagLocalOnly, flagJoined},
+	{"-fsanitize-coverage-ignorelist=", FlagLocalOnly, flagJoined},
+	{"-fsanitize-coverage-whitelist=", FlagLocalOnly, flagJoined},
+	{"-fsanitize-coverage-blacklist=", FlagLocalOnly, flagJoined},
+	{"-fxray-always-instrument=", FlagLocalOnly, flagJoined},
+	{"-fxray-never-instrument=", FlagLocalOnly, flagJoined},
+	{"-fxray-attr-list=", FlagLocalOnly, flagJoined},
+	{"-fmodule-file=", FlagLocalOnly, flagJoined},
+	// the module cache is on this machine, and servers deny these by default
+	{"-fmodules-cache-path=", FlagLocalOnly, flagJoined},
+	{"-fbuild-session-file=", FlagLocalOnly, flagJoined},
+	{"-fplugin=", FlagLocalOnly, flagJoined},
+	{"-B", FlagLocalOnly, flagJoinedOrSeparate},
+	{"--config", FlagLocalOnly, flagJoinedOrSeparate},
+	{"-emit-pch", FlagLocalOnly, flagNoValue},
+	// LLVM options can load code and write anywhere, and servers deny them
+	{"-mllvm", FlagLocalOnly, flagSeparate},
+
+	// link
+	{"-l", FlagLink, flagJoinedOrSeparate},
+	{"-L", FlagLink, flagJoinedOrSeparate},
+	{"-framework", FlagLink, flagSeparate},
+	{"-weak_framework", FlagLink, flagSeparate},
+	{"-Wl,", FlagLink, flagJoined},
+	{"-Xlinker", FlagLink, flagSeparate},
+	{"-shared", FlagLink, flagNoValue},
+	{"-dynamiclib", FlagLink, flagNoValue},
+	{"-bundle", FlagLink, flagNoValue},
+	{"-static", FlagLink, flagNoValue},
+	{"-nostdlib", FlagLink, flagNoValue},
+	{"-rdynamic", FlagLink, flagNoValue},
+	{"-filelist", FlagLink, flagSeparate},
+	{"-install_name", FlagLink, flagSeparate},
+	{"-fuse-ld=", FlagLink, flagJoined},
+}
+
+// outputFlags are the flags whose value is a path the compiler writes to.
+var outputFlags = map[string]bool{
+	"-o":                          true,
+	"-MF":                         true,
+	"-MJ":                         true,
+	"-serialize-diagnostics":      true,
+	"--serialize-diagnostics":     true,
+	"-index-store-path":           true,
+	"-ftime-trace=":               true,
+	"-foptimization-record-file=": true,
+	"-fproc-stat-report=":         true,
+}
+
+// outputDirFlags are the output flags whose value is a directory the compiler writes files under.
+var outputDirFlags = map[string]bool{
+	"-index-store-path": true,
+}
+
+// implicitOutputFlags are the flags that make the compiler write files it names itself, next to
+// the object or in the working directory.
+var implicitOutputFlags = map[string]bool{
+	"-MD":           true,
+	"-MMD":          true,
+	"-save-temps":   true,
+	"-ftime-trace":  true,
+	"-gsplit-dwarf": true,
+}
+
+// implicitOutputExts are the extensions of the files that implicitOutputFlags make the compiler
+// write, named after the object or the input.
+var implicitOutputExts = map[string]bool{
+	".d":    true,
+	".dwo":  true,
+	".json": true,
+	".i":    true,
+	".ii":   true,
+	".mi":   true,
+	".mii":  true,
+	".s":    true,
+	".bc":   true,
+}
+
+// depFlags are the flags that control writing a dependency file.
+var depFlags = map[string]bool{
+	"-MD":  true,
+	"-MMD": true,
+	"-MP":  true,
+	"-MG":  true,
+	"-MV":  true,
+	"-MF":  true,
+	"-MT":  true,
+	"-MQ":  true,
+}
+
+// lookupFlag returns the table entry for tok, preferring the longest matching name so that, for
+// example, -fplugin= wins over -f.
+func lookupFlag(tok string) (res flagSpec, ok bool) {
+	for _, spec := range flagTable {
+		var match bool
+		switch spec.form {
+		case flagNoValue, flagSeparate:
+			match = tok == spec.name
+		case flagJoined, flagJoinedOrSeparate:
+			match = strings.HasPrefix(tok, spec.name)
+		}
+		if match && len(spec.name) > len(res.name) {
+			res = spec
+			ok = true
+		}
+	}
+	return res, ok
+}
+
+func (s flagSpec) takesValue(tok string) bool {
+	return s.form == flagSeparate || (s.form == flagJoinedOrSeparate && tok == s.name)
+}
+
+func (s flagSpec) hasJoinedValue(tok string) bool {
+	return (s.form == flagJoined || s.form == flagJoinedOrSeparate) && tok != s.name
+}
+
+// ClassifyFlag returns the kind of the flag tok, and whether it takes the following token as its
+// value.
+func ClassifyFlag(tok string) (kind FlagKind, takesValue bool) {
+	spec, ok := lookupFlag(tok)
+	if !ok {
+		return FlagUnknown, false
+	}
+	return spec.kind, spec.takesValue(tok)
+}
+
+// CmdFlags is the result of classifying every token of a command.
+type CmdFlags struct {
+	// Inputs are the positional arguments, with their indexes into the command tokens.
+	Inputs       []string
+	InputIndexes []int
+	// Modes are the mode flags present, such as -c and -E.
+	Modes   []string
+	Local   []string
+	Link    []string
+	Unknown []string
+	// MissingValue is set if the command ends with a flag that needs a value.
+	MissingValue string
+	// ExtraOutputs is set if the command writes files other than the object and dependency file.
+	ExtraOutputs bool
+}
+
+func (f CmdFlags) hasMode(mode string) bool {
+	for _, m := range f.Modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalReason returns why the command cannot be distributed, or the empty string if it can.
+func (f CmdFlags) LocalReason() string {
+	switch {
+	case len(f.MissingValue) > 0:
+		return fmt.Sprintf("missing value for %s", f.MissingValue)
+	case len(f.Unknown) > 0:
+		return fmt.Sprintf("unknown flags: %s", strings.Join(f.Unknown, " "))
+	case len(f.Local) > 0:
+		return fmt.Sprintf("local-only flags: %s", strings.Join(f.Local, " "))
+	case len(f.Link) > 0:
+		return fmt.Sprintf("link flags: %s", strings.Join(f.Link, " "))
+	case !f.hasMode("-c"):
+		return "not a compile (-c) command"
+	case len(f.Modes) > 1:
+		// -E, -S, -M and friends override or change what -c produces
+		return fmt.Sprintf("unsupported mode: %s", strings.Join(f.Modes, " "))
+	case len(f.Inputs) == 0:
+		return "no input file"
+	case len(f.Inputs) > 1:
+		return fmt.Sprintf("multiple input files: %s", strings.Join(f.Inputs, " "))
+	case f.Inputs[0] == "-":
+		return "input from stdin"
+	}
+	return ""
+}
+
+// ClassifyFlags walks the command tokens, skipping the compiler, and sorts them using the flag
+// table.
+func (c *XcodeCmd) ClassifyFlags() (res CmdFlags) {
+	start := 0
+	if c.hasCompiler() {
+		start = 1
+	}
+	for index := start; index < len(c.toks); index++ {
+		tok := c.toks[index]
+		if strings.HasPrefix(tok, "@") {
+			// response files, collected below
+			continue
+		}
+		if tok == "-" || !strings.HasPrefix(tok, "-") {
+			res.Inputs = append(res.Inputs, tok)
+			res.InputIndexes = append(res.InputIndexes, index)
+			continue
+		}
+		spec, _ := lookupFlag(tok)
+		kind, takesValue := ClassifyFlag(tok)
+		if (outputFlags[spec.name] || implicitOutputFlags[spec.name]) && !depFlags[spec.name] &&
+			spec.name != "-o" {
+			res.ExtraOutputs = true
+		}
+		name := tok
+		if takesValue {
+			if index == len(c.toks)-1 {
+				res.MissingValue = tok
+				break
+			}
+			index++
+			name = tok + " " + c.toks[index]
+		}
+		switch kind {
+		case FlagMode:
+			res.Modes = append(res.Modes, tok)
+		case FlagLocalOnly:
+			res.Local = append(res.Local, name)
+		case FlagLink:
+			res.Link = append(res.Link, name)
+		case FlagUnknown:
+			res.Unknown = append(res.Unknown, tok)
+		}
+	}
+	// the driver expands response files before anything else, so we can not tell what is in them
+	res.Unknown = append(res.Unknown, c.ResponseFileArgs()...)
+	return res
+}
+
+// ResponseFileArgs returns the tokens of the command that start with @, which the driver reads
+// more arguments from, and the flags with joined values that start with @.
+func (c *XcodeCmd) ResponseFileArgs() (res []string) {
+	for index, tok := range c.toks {
+		if index == 0 && c.hasCompiler() {
+			continue
+		}
+		if strings.HasPrefix(tok, "@") {
+			res = append(res, tok)
+			continue
+		}
+		if !strings.HasPrefix(tok, "-") {
+			continue
+		}
+		if spec, ok := lookupFlag(tok); ok && spec.hasJoinedValue(tok) && strings.HasPrefix(tok[len(spec.name):], "@") {
+			res = append(res, tok)
+		}
+	}
+	return res
+}
+
+// readPathFlags are the flags whose value is a file or directory the preprocessor reads from.
+var readPathFlags = map[string]bool{
+	"-I":                     true,
+	"-F":                     true,
+	"-isystem":               true,
+	"-iquote":                true,
+	"-idirafter":             true,
+	"-iframework":            true,
+	"-iframeworkwithsysroot": true,
+	"-iprefix":               true,
+	"-isysroot":              true,
+	"--sysroot":              true,
+	"--sysroot=":             true,
+	"-include":               true,
+	"-imacros":               true,
+	"-ivfsoverlay":           true,
+	"-fmodule-map-file=":     true,
+}
+
+// ReadPaths returns the absolute paths named by flags that make the preprocessor read files, such
+// as header search directories and forced includes.
+func (c *XcodeCmd) ReadPaths() (res []string) {
+	c.walkFlagValues(func(name, value string) string {
+		if readPathFlags[name] {
+			if path, err := c.AbsPath(value); err == nil {
+				res = append(res, path)
+			}
+		}
+		return value
+	})
+	return res
+}
+
+// FlagArg is one flag of a command.
+type FlagArg struct {
+	Kind FlagKind
+	// Text is the flag as written, followed by a space and its value if the value is a separate
+	// token.
+	Text string
+}
+
+// FlagArgs returns the flags of the command in order, skipping the compiler and inputs.
+func (c *XcodeCmd) FlagArgs() (res []FlagArg) {
+	start := 0
+	if c.hasCompiler() {
+		start = 1
+	}
+	for index := start; index < len(c.toks); index++ {
+		tok := c.toks[index]
+		if tok == "-" || !strings.HasPrefix(tok, "-") {
+			continue
+		}
+		kind, takesValue := ClassifyFlag(tok)
+		text := tok
+		if takesValue && index < len(c.toks)-1 {
+			index++
+			text = tok + " " + c.toks[index]
+		}
+		res = append(res, FlagArg{
+			Kind: kind,
+			Text: text,
+		})
+	}
+	return res
+}
+
+// walkFlagValues calls fn with the table name and value of every flag that has one, and replaces
+// the value with what fn returns.
+func (c *XcodeCmd) walkFlagValues(fn func(name, value string) string) {
+	start := 0
+	if c.hasCompiler() {
+		start = 1
+	}
+	for index := start; index < len(c.toks); index++ {
+		tok := c.toks[index]
+		if !strings.HasPrefix(tok, "-") {
+			continue
+		}
+		spec, ok := lookupFlag(tok)
+		if !ok {
+			continue
+		}
+		switch {
+		case spec.takesValue(tok):
+			if index == len(c.toks)-1 {
+				return
+			}
+			index++
+			c.toks[index] = fn(spec.name, c.toks[index])
+		case spec.hasJoinedValue(tok):
+			c.toks[index] = spec.name + fn(spec.name, tok[len(spec.name):])
+		}
+	}
+}
+
+// OutputPaths returns the paths named by flags that write files, such as -o and -MF.
+func (c *XcodeCmd) OutputPaths() (res []string) {
+	c.walkFlagValues(func(name, value string) string {
+		if outputFlags[name] {
+			res = append(res, value)
+		}
+		return value
+	})
+	return res
+}
+
+// AllowsOutput returns whether the command writes the file at the absolute path: one named by an
+// output flag, one under a directory named by an output flag, or, if the command has a flag that
+// names its own outputs, one next to the object or in the working directory that is named after
+// the object or the input with an extension those flags use.
+func (c *XcodeCmd) AllowsOutput(path string) bool {
+	path = filepath.Clean(path)
+	allowed := false
+	c.walkFlagValues(func(name, value string) string {
+		if !outputFlags[name] {
+			return value
+		}
+		abspath, err := c.AbsPath(value)
+		if err != nil {
+			return value
+		}
+		if outputDirFlags[name] {
+			allowed = allowed || strings.HasPrefix(path, abspath+string(filepath.Separator))
+		} else {
+			allowed = allowed || abspath == path
+		}
+		return value
+	})
+	if allowed || !c.hasImplicitOutputs() {
+		return allowed
+	}
+	ext := filepath.Ext(path)
+	if !implicitOutputExts[ext] {
+		return false
+	}
+	var dirs, stems []string
+	if wd, err := c.AbsPath("."); err == nil {
+		dirs = append(dirs, wd)
+	}
+	if output, err := c.GetOutputFilepath(); err == nil {
+		if output, err = c.AbsPath(output); err == nil {
+			dirs = append(dirs, filepath.Dir(output))
+			stems = append(stems, strings.TrimSuffix(filepath.Base(output), filepath.Ext(output)))
+		}
+	}
+	if input, err := c.GetInputFilepath(); err == nil {
+		stems = append(stems, strings.TrimSuffix(filepath.Base(input), filepath.Ext(input)))
+	}
+	if !containsString(stems, strings.TrimSuffix(filepath.Base(path), ext)) {
+		return false
+	}
+	return containsString(dirs, filepath.Dir(path))
+}
+
+// hasImplicitOutputs returns whether the command has a flag that makes the compiler write a file
+// it names itself. -MD and -MMD only do when -MF does not name the dep file.
+func (c *XcodeCmd) hasImplicitOutputs() bool {
+	_, err := c.GetDepFilepath()
+	hasDepFile := err == nil
+	for index, tok := range c.toks {
+		if index == 0 && c.hasCompiler() {
+			continue
+		}
+		spec, ok := lookupFlag(tok)
+		if !ok || !strings.HasPrefix(tok, "-") || !implicitOutputFlags[spec.name] {
+			continue
+		}
+		if depFlags[spec.name] && hasDepFile {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// RelocateOutputPaths replaces every path named by a flag that writes files with what fn returns.
+func (c *XcodeCmd) RelocateOutputPaths(fn func(path string) string) {
+	c.walkFlagValues(func(name, value string) string {
+		if outputFlags[name] {
+			return fn(value)
+		}
+		return value
+	})
+}
+
+// RemoveDepFlags removes every flag that asks for a dependency file, for use once the dependency
+// file has already been written by preprocessing.
+func (c *XcodeCmd) RemoveDepFlags() {
+	toks := make([]string, 0, len(c.toks))
+	for index := 0; index < len(c.toks); index++ {
+		tok := c.toks[index]
+		if index == 0 && c.hasCompiler() {
+			toks = append(toks, tok)
+			continue
+		}
+		spec, ok := lookupFlag(tok)
+		if !ok || !strings.HasPrefix(tok, "-") {
+			toks = append(toks, tok)
+			continue
+		}
+		if spec.takesValue(tok) {
+			if !depFlags[spec.name] {
+				toks = append(toks, tok)
+				if index < len(c.toks)-1 {
+					toks = append(toks, c.toks[index+1])
+				}
+			}
+			index++
+			continue
+		}
+		if !depFlags[spec.name] {
+			toks = append(toks, tok)
+		}
+	}
+	c.toks = toks
+}
@@ -0,0 +1,306 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// The handshake is modeled on Noise IK. The client knows the server's static key up front and
+// sends an ephemeral key, then its own static key encrypted to the server, with a tag proving it
+// holds the private half. The server answers with its own ephemeral key and a tag only the holder
+// of its static key could produce, which confirms the key to the client. Session keys mix in the
+// ephemeral-ephemeral exchange, so recorded traffic stays secret if static keys later leak.
+//
+//	client -> server: magic, e, seal(c), seal()
+//	server -> client: status, re, seal()
+
+const handshakeMagic = "XCDHS\x00\x00\x01"
+
+const handshakeTimeout = 10 * time.Second
+
+const (
+	handshakeStatusOK byte = iota
+	handshakeStatusUnauthorized
+	handshakeStatusFailed
+)
+
+const (
+	handshakeKeySize  = 32
+	handshakeTagSize  = chacha20poly1305.Overhead
+	handshakeMsg1Size = len(handshakeMagic) + handshakeKeySize + handshakeKeySize + 2*handshakeTagSize
+	handshakeMsg2Size = 1 + handshakeKeySize + handshakeTagSize
+)
+
+var (
+	ErrHandshakeUnauthorized = errors.New("server does not authorize this client key")
+	ErrHandshakeServerKey    = errors.New("server public key mismatch")
+	errHandshakeFailed       = errors.New("handshake failed")
+)
+
+// HandshakeResult is what a server learns from a handshake.
+type HandshakeResult struct {
+	Session *Session
+	// Client is the client's static key, or nil if it did not send one.
+	Client *PublicKey
+	// Legacy is set if the client used the old handshake, which only sends an ephemeral key and
+	// authenticates neither side.
+	Legacy bool
+}
+
+type handshakeState struct {
+	hash      hash.Hash
+	chainKey  []byte
+	cipherKey []byte
+}
+
+func newHandshakeState(serverKey PublicKey) *handshakeState {
+	chainKey := sha256.Sum256([]byte(handshakeMagic))
+	s := &handshakeState{
+		hash:     sha256.New(),
+		chainKey: chainKey[:],
+	}
+	s.mixHash([]byte(handshakeMagic))
+	s.mixHash(serverKey.Slice())
+	return s
+}
+
+func (s *handshakeState) mixHash(dat []byte) {
+	s.hash.Write(dat)
+}
+
+func (s *handshakeState) mixKey(input []byte) {
+	var out [2 * handshakeKeySize]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, input, s.chainKey, []byte("xcdistcc")), out[:]); err != nil {
+		panic(err)
+	}
+	s.chainKey = out[:handshakeKeySize]
+	s.cipherKey = out[handshakeKeySize:]
+}
+
+func (s *handshakeState) mixDH(private, public []byte) error {
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return errors.Wrap(err, "invalid key")
+	}
+	s.mixKey(shared)
+	return nil
+}
+
+// seal encrypts plaintext with the current key, bound to the transcript so far, and adds the
+// result to the transcript. Each key is only ever used once, so a zero nonce is safe.
+func (s *handshakeState) seal(plaintext []byte) []byte {
+	aead, err := chacha20poly1305.New(s.cipherKey)
+	if err != nil {
+		panic(err)
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	res := aead.Seal(nil, nonce[:], plaintext, s.hash.Sum(nil))
+	s.mixHash(res)
+	return res
+}
+
+func (s *handshakeState) open(ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(s.cipherKey)
+	if err != nil {
+		panic(err)
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	res, err := aead.Open(nil, nonce[:], ciphertext, s.hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return res, nil
+}
+
+// split derives a key for each direction from the finished handshake, and returns the session for
+// the client or the server end.
+func (s *handshakeState) split(client bool) *Session {
+	s.mixKey(s.hash.Sum(nil))
+	clientKey, serverKey := s.chainKey, s.cipherKey
+	if client {
+		return newSession(clientKey, serverKey)
+	}
+	return newSession(serverKey, clientKey)
+}
+
+func generateHandshakeKey() (public, private []byte, err error) {
+	private = make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, private); err != nil {
+		return nil, nil, err
+	}
+	if public, err = curve25519.X25519(private, curve25519.Basepoint); err != nil {
+		return nil, nil, err
+	}
+	return public, private, nil
+}
+
+// ClientHandshake runs the client side of the handshake on conn, authenticating as identity if it
+// is not nil, and returns the session for the connection.
+func ClientHandshake(conn net.Conn, serverKey PublicKey, identity *KeyPair) (*Session, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	state := newHandshakeState(serverKey)
+	ephemeralPublic, ephemeralPrivate, err := generateHandshakeKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate ephemeral key")
+	}
+	msg := []byte(handshakeMagic)
+	msg = append(msg, ephemeralPublic...)
+	state.mixHash(ephemeralPublic)
+	if err := state.mixDH(ephemeralPrivate, serverKey.Slice()); err != nil {
+		return nil, err
+	}
+	// a client without an identity sends an all zero key, and skips the static DH
+	var clientPublic [handshakeKeySize]byte
+	if identity != nil {
+		clientPublic = identity.Public.Raw()
+	}
+	msg = append(msg, state.seal(clientPublic[:])...)
+	if identity != nil {
+		if err := state.mixDH(identity.Private.RawPtr()[:], serverKey.Slice()); err != nil {
+			return nil, err
+		}
+	} else {
+		state.mixKey(nil)
+	}
+	msg = append(msg, state.seal(nil)...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, errors.Wrap(err, "failed to send handshake")
+	}
+
+	reply := make([]byte, handshakeMsg2Size)
+	if _, err := io.ReadFull(conn, reply[:1]); err != nil {
+		return nil, errors.Wrap(err, "failed to read handshake reply, the server may predate this handshake")
+	}
+	switch reply[0] {
+	case handshakeStatusOK:
+	case handshakeStatusUnauthorized:
+		return nil, ErrHandshakeUnauthorized
+	default:
+		// the server could not open our first message, which means we encrypted it to the wrong key
+		return nil, ErrHandshakeServerKey
+	}
+	if _, err := io.ReadFull(conn, reply[1:]); err != nil {
+		return nil, errors.Wrap(err, "failed to read handshake reply")
+	}
+	replyPublic := reply[1 : 1+handshakeKeySize]
+	state.mixHash(replyPublic)
+	if err := state.mixDH(ephemeralPrivate, replyPublic); err != nil {
+		return nil, err
+	}
+	if identity != nil {
+		if err := state.mixDH(identity.Private.RawPtr()[:], replyPublic); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := state.open(reply[1+handshakeKeySize:]); err != nil {
+		return nil, ErrHandshakeServerKey
+	}
+	return state.split(true), nil
+}
+
+// ServerHandshake runs the server side of the handshake on conn. authorize is called with the
+// client's static key, or nil if it did not send one, and rejects the client by returning an
+// error. Clients using the legacy handshake, which has no key confirmation, forward secrecy or
+// replay protection, are only accepted if allowLegacy is set, and are not checked with authorize.
+// Every message of the handshake has a fixed size, so a client can not make the server read more
+// than that; the caller is responsible for deadlines.
+func ServerHandshake(conn net.Conn, keyPair KeyPair, allowLegacy bool,
+	authorize func(client *PublicKey) error) (res HandshakeResult, err error) {
+	msg := make([]byte, handshakeMsg1Size)
+	if _, err := io.ReadFull(conn, msg[:len(handshakeMagic)]); err != nil {
+		return res, errors.Wrap(err, "failed to read handshake")
+	}
+	if !bytes.Equal(msg[:len(handshakeMagic)], []byte(handshakeMagic)) {
+		// older clients send only an ephemeral key, of which we have just read the start
+		if !allowLegacy {
+			return res, errors.Wrap(errHandshakeFailed, "legacy handshake not allowed")
+		}
+		return serverLegacyHandshake(conn, keyPair, msg[:len(handshakeMagic)])
+	}
+	if _, err := io.ReadFull(conn, msg[len(handshakeMagic):]); err != nil {
+		return res, errors.Wrap(err, "failed to read handshake")
+	}
+	reject := func(status byte, err error) (HandshakeResult, error) {
+		conn.Write([]byte{status})
+		return HandshakeResult{}, err
+	}
+
+	state := newHandshakeState(keyPair.Public)
+	offset := len(handshakeMagic)
+	ephemeralPublic := msg[offset : offset+handshakeKeySize]
+	offset += handshakeKeySize
+	state.mixHash(ephemeralPublic)
+	if err := state.mixDH(keyPair.Private.RawPtr()[:], ephemeralPublic); err != nil {
+		return reject(handshakeStatusFailed, err)
+	}
+	clientPublic, err := state.open(msg[offset : offset+handshakeKeySize+handshakeTagSize])
+	if err != nil {
+		return reject(handshakeStatusFailed, errors.Wrap(errHandshakeFailed, "client used the wrong server key"))
+	}
+	offset += handshakeKeySize + handshakeTagSize
+	var zero [handshakeKeySize]byte
+	if !bytes.Equal(clientPublic, zero[:]) {
+		res.Client = new(PublicKey)
+		copy(res.Client[:], clientPublic)
+		if err := state.mixDH(keyPair.Private.RawPtr()[:], clientPublic); err != nil {
+			return reject(handshakeStatusFailed, err)
+		}
+	} else {
+		state.mixKey(nil)
+	}
+	if _, err := state.open(msg[offset:]); err != nil {
+		return reject(handshakeStatusFailed, errors.Wrap(errHandshakeFailed, "client key proof invalid"))
+	}
+	if err := authorize(res.Client); err != nil {
+		return reject(handshakeStatusUnauthorized, err)
+	}
+
+	replyPublic, replyPrivate, err := generateHandshakeKey()
+	if err != nil {
+		return reject(handshakeStatusFailed, errors.Wrap(err, "failed to generate ephemeral key"))
+	}
+	reply := []byte{handshakeStatusOK}
+	reply = append(reply, replyPublic...)
+	state.mixHash(replyPublic)
+	if err := state.mixDH(replyPrivate, ephemeralPublic); err != nil {
+		return res, err
+	}
+	if res.Client != nil {
+		if err := state.mixDH(replyPrivate, res.Client.Slice()); err != nil {
+			return res, err
+		}
+	}
+	reply = append(reply, state.seal(nil)...)
+	if _, err := conn.Write(reply); err != nil {
+		return res, errors.Wrap(err, "failed to send handshake reply")
+	}
+	res.Session = state.split(false)
+	return res, nil
+}
+
+func serverLegacyHandshake(conn net.Conn, keyPair KeyPair, prefix []byte) (res HandshakeResult, err error) {
+	var ephemeral [handshakeKeySize]byte
+	copy(ephemeral[:], prefix)
+	if _, err := io.ReadFull(conn, ephemeral[len(prefix):]); err != nil {
+		return res, errors.Wrap(err, "failed to read legacy handshake")
+	}
+	var out [32]byte
+	box.Precompute(&out, &ephemeral, keyPair.Private.RawPtr())
+	res.Session = newLegacySession(NewSharedSecret(out))
+	res.Legacy = true
+	return res, nil
+}
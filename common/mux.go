@@ -0,0 +1,154 @@
+package common
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var errMuxConnClosed = errors.New("connection closed")
+
+type RPCConn interface {
+	Call(cmd Cmd) (CmdResponse, error)
+}
+
+type muxResult struct {
+	resp CmdResponse
+	err  error
+}
+
+// MuxConn multiplexes concurrent RPCs over a single connection, matching responses to requests
+// by ID.
+type MuxConn struct {
+	conn    net.Conn
+	session *Session
+	sendMu  sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan muxResult
+	err     error
+}
+
+func NewMuxConn(conn net.Conn, session *Session) *MuxConn {
+	m := &MuxConn{
+		conn:    conn,
+		session: session,
+		pending: make(map[uint64]chan muxResult),
+	}
+	go m.readLoop()
+	return m
+}
+
+func (m *MuxConn) IsClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err != nil
+}
+
+func (m *MuxConn) Close() error {
+	m.fail(errMuxConnClosed)
+	return m.conn.Close()
+}
+
+func (m *MuxConn) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	for id, ch := range m.pending {
+		ch <- muxResult{err: err}
+		delete(m.pending, id)
+	}
+}
+
+// takePending removes and returns the waiter for id. Servers that predate multiplexing answer
+// in order without an ID, so an ID of zero goes to the oldest outstanding request.
+func (m *MuxConn) takePending(id uint64) (chan muxResult, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id == 0 {
+		for pid := range m.pending {
+			if id == 0 || pid < id {
+				id = pid
+			}
+		}
+	}
+	ch, ok := m.pending[id]
+	delete(m.pending, id)
+	return ch, ok
+}
+
+func (m *MuxConn) readLoop() {
+	for {
+		dat, err := RPCRecvRaw(m.conn, m.session, DefaultMaxFrameSize)
+		if err != nil {
+			m.fail(err)
+			m.conn.Close()
+			return
+		}
+		var resp CmdResponse
+		if err := msgpack.Unmarshal(dat, &resp); err != nil {
+			m.fail(errors.Wrap(err, "failed to decode response"))
+			m.conn.Close()
+			return
+		}
+		ch, ok := m.takePending(resp.ID)
+		if !ok {
+			continue
+		}
+		ch <- muxResult{resp: resp}
+	}
+}
+
+func (m *MuxConn) register() (uint64, chan muxResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return 0, nil, m.err
+	}
+	m.nextID++
+	ch := make(chan muxResult, 1)
+	m.pending[m.nextID] = ch
+	return m.nextID, ch, nil
+}
+
+func (m *MuxConn) unregister(id uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pending, id)
+}
+
+func (m *MuxConn) Call(cmd Cmd) (res CmdResponse, err error) {
+	id, ch, err := m.register()
+	if err != nil {
+		return res, err
+	}
+	cmd.ID = id
+	dat, err := msgpack.Marshal(cmd)
+	if err != nil {
+		m.unregister(id)
+		return res, errors.Wrap(err, "failed to encode req")
+	}
+	m.sendMu.Lock()
+	err = RPCSendRaw(m.conn, dat, m.session)
+	m.sendMu.Unlock()
+	if err != nil {
+		// a partial write leaves the stream unusable for everyone else too
+		m.fail(err)
+		m.conn.Close()
+		return res, err
+	}
+	select {
+	case result := <-ch:
+		return result.resp, result.err
+	case <-time.After(10 * time.Minute):
+		m.unregister(id)
+		return res, errors.New("timed out waiting for response")
+	}
+}
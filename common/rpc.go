@@ -3,25 +3,20 @@ package common
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/rand"
-	"encoding/binary"
 	"io"
 	"net"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/vmihailenco/msgpack/v5"
-	"golang.org/x/crypto/nacl/box"
 )
 
-func makeNonce() (res [24]byte, err error) {
-	if _, err := io.ReadFull(rand.Reader, res[:]); err != nil {
-		return res, err
-	}
-	return res, nil
-}
+// DefaultMaxFrameSize is the largest message accepted by default, compressed or not.
+const DefaultMaxFrameSize = 256 * 1024 * 1024
+
+var ErrFrameTooLarge = errors.New("frame too large")
 
-func RPCSendRaw(conn net.Conn, raw []byte, secret *SharedSecret) error {
+func RPCSendRaw(conn net.Conn, raw []byte, session *Session) error {
 	var gzipBuf bytes.Buffer
 	compressor := gzip.NewWriter(&gzipBuf)
 	if _, err := io.Copy(compressor, bytes.NewBuffer(raw)); err != nil {
@@ -30,30 +25,14 @@ func RPCSendRaw(conn net.Conn, raw []byte, secret *SharedSecret) error {
 	if err := compressor.Close(); err != nil {
 		return errors.Wrap(err, "failed to close compress")
 	}
-	dat := gzipBuf.Bytes()
-	var nonce [24]byte
-	if secret != nil {
-		var err error
-		if nonce, err = makeNonce(); err != nil {
-			return errors.Wrap(err, "failed to make nonce")
-		}
-		dat = box.SealAfterPrecomputation(nil, dat, &nonce, secret.RawPtr())
+	frame, err := session.sealFrame(gzipBuf.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "failed to seal msg")
 	}
 
-	var sz uint32
-	sz = uint32(len(dat))
 	errCh := make(chan error, 1)
 	go func() {
-		if secret != nil {
-			if _, err := io.Copy(conn, bytes.NewBuffer(nonce[:])); err != nil {
-				errCh <- errors.Wrap(err, "failed to write nonce")
-			}
-		}
-		if err := binary.Write(conn, binary.BigEndian, sz); err != nil {
-			errCh <- errors.Wrap(err, "failed to write len")
-			return
-		}
-		if _, err := io.CopyN(conn, bytes.NewBuffer(dat), int64(sz)); err != nil {
+		if _, err := io.Copy(conn, bytes.NewBuffer(frame)); err != nil {
 			errCh <- errors.Wrap(err, "failed to write msg")
 			return
 		}
@@ -67,18 +46,21 @@ func RPCSendRaw(conn net.Conn, raw []byte, secret *SharedSecret) error {
 	}
 }
 
-func RPCRecvRaw(conn net.Conn, secret *SharedSecret) (res []byte, err error) {
-	var nonce [24]byte
-	if secret != nil {
-		if _, err := io.ReadFull(conn, nonce[:]); err != nil {
-			return res, errors.Wrap(err, "failed to read nonce")
-		}
-	}
-	var sz uint32
-	if err := binary.Read(conn, binary.BigEndian, &sz); err != nil {
+// RPCRecvRaw reads one message from conn, refusing messages over maxSize bytes before reading them
+// and while decompressing them.
+func RPCRecvRaw(conn net.Conn, session *Session, maxSize int) (res []byte, err error) {
+	rawHeader := make([]byte, session.headerSize())
+	if _, err := io.ReadFull(conn, rawHeader); err != nil {
 		return res, errors.Wrap(err, "failed to read response size")
 	}
-	resp := make([]byte, sz)
+	header, err := session.openHeader(rawHeader)
+	if err != nil {
+		return res, err
+	}
+	if int64(header.size) > int64(maxSize) {
+		return res, errors.Wrapf(ErrFrameTooLarge, "%d bytes", header.size)
+	}
+	resp := make([]byte, header.size)
 	errCh := make(chan error, 1)
 	go func() {
 		if _, err := io.ReadFull(conn, resp); err != nil {
@@ -95,21 +77,24 @@ func RPCRecvRaw(conn net.Conn, secret *SharedSecret) (res []byte, err error) {
 	case <-time.After(time.Minute):
 		return res, errors.New("rpc recv timeout")
 	}
-	if secret != nil {
-		var ok bool
-		if resp, ok = box.OpenAfterPrecomputation(nil, resp, &nonce, secret.RawPtr()); !ok {
-			return res, errors.New("decrypt failed")
-		}
+	if resp, err = session.openBody(header, resp); err != nil {
+		return res, err
 	}
 
 	decompressor, err := gzip.NewReader(bytes.NewBuffer(resp))
 	if err != nil {
 		return res, errors.Wrap(err, "failed to decompress")
 	}
-	return io.ReadAll(decompressor)
+	if res, err = io.ReadAll(io.LimitReader(decompressor, int64(maxSize)+1)); err != nil {
+		return res, errors.Wrap(err, "failed to decompress")
+	}
+	if len(res) > maxSize {
+		return nil, errors.Wrap(ErrFrameTooLarge, "decompressed")
+	}
+	return res, nil
 }
 
-func DoRPC[ReqTyp any, PayloadTyp any](conn net.Conn, method string, req ReqTyp, secret *SharedSecret) (res PayloadTyp, err error) {
+func DoRPC[ReqTyp any, PayloadTyp any](conn RPCConn, method string, req ReqTyp) (res PayloadTyp, err error) {
 	cmdreq := Cmd{
 		Name: method,
 	}
@@ -118,42 +103,23 @@ func DoRPC[ReqTyp any, PayloadTyp any](conn net.Conn, method string, req ReqTyp,
 		return res, errors.Wrap(err, "failed to encode req args")
 	}
 	cmdreq.Args = dat
-	if dat, err = msgpack.Marshal(cmdreq); err != nil {
-		return res, errors.Wrap(err, "failed to encode req")
-	}
 
-	// send/recv
-	if err := RPCSendRaw(conn, dat, secret); err != nil {
-		return res, err
-	}
-	respCh := make(chan []byte, 1)
-	errCh := make(chan error, 1)
-	go func() {
-		resp, err := RPCRecvRaw(conn, secret)
-		if err != nil {
-			errCh <- err
-		}
-		respCh <- resp
-	}()
-	var resp []byte
-	select {
-	case resp = <-respCh:
-	case err := <-errCh:
+	cmdres, err := conn.Call(cmdreq)
+	if err != nil {
 		return res, err
-	case <-time.After(10 * time.Minute):
-		return res, errors.New("timed out waiting for response")
-	}
-
-	// parse response
-	var cmdres CmdResponse
-	if err := msgpack.Unmarshal(resp, &cmdres); err != nil {
-		return res, errors.Wrap(err, "failed to decode response")
 	}
 	if !cmdres.Success {
-		return res, errors.New(*cmdres.ErrorMsg)
+		var msg string
+		if cmdres.ErrorMsg != nil {
+			msg = *cmdres.ErrorMsg
+		}
+		return res, RPCError{
+			Code: cmdres.ErrorCode,
+			Msg:  msg,
+		}
 	}
 	if err := msgpack.Unmarshal(cmdres.Payload, &res); err != nil {
-		return res, errors.Wrap(err, "fsailedf to decode payload")
+		return res, errors.Wrap(err, "failed to decode payload")
 	}
 	return res, nil
 }
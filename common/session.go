@@ -0,0 +1,169 @@
+package common
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Frames on an encrypted connection are a sealed 4 byte length followed by the sealed message.
+// Each direction has its own key, and nonces are a per-direction counter that is never sent, so a
+// frame that is replayed, dropped or reordered fails to open and the connection is dropped. The
+// length is opened before any of the message is read, so a peer without the key can not make us
+// allocate for it.
+
+const (
+	frameSizeSize       = 4
+	sealedFrameSizeSize = frameSizeSize + chacha20poly1305.Overhead
+	legacyNonceSize     = 24
+)
+
+var (
+	errFrameAuth        = errors.New("frame failed to authenticate, it may have been replayed, reordered or tampered with")
+	errSessionExhausted = errors.New("session nonces exhausted")
+)
+
+type sessionCipher struct {
+	aead    cipher.AEAD
+	counter uint64
+}
+
+func newSessionCipher(key []byte) sessionCipher {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		panic(err)
+	}
+	return sessionCipher{aead: aead}
+}
+
+func (c *sessionCipher) nextNonce() ([]byte, error) {
+	if c.counter == math.MaxUint64 {
+		return nil, errSessionExhausted
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], c.counter)
+	c.counter++
+	return nonce, nil
+}
+
+func (c *sessionCipher) seal(dst, plaintext []byte) ([]byte, error) {
+	nonce, err := c.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(dst, nonce, plaintext, nil), nil
+}
+
+func (c *sessionCipher) open(ciphertext []byte) ([]byte, error) {
+	nonce, err := c.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errFrameAuth
+	}
+	return res, nil
+}
+
+// Session holds the encryption state for one connection. A nil Session sends frames in the clear.
+// Sends and receives must each be serialized by the caller.
+type Session struct {
+	send sessionCipher
+	recv sessionCipher
+	// legacy is set for peers using the old handshake, whose frames carry a random nonce and are
+	// sealed with a single shared key in both directions.
+	legacy *SharedSecret
+}
+
+func newSession(sendKey, recvKey []byte) *Session {
+	return &Session{
+		send: newSessionCipher(sendKey),
+		recv: newSessionCipher(recvKey),
+	}
+}
+
+// newLegacySession makes a session using the framing of peers that predate per-direction keys.
+func newLegacySession(secret SharedSecret) *Session {
+	return &Session{legacy: &secret}
+}
+
+type frameHeader struct {
+	size  uint32
+	nonce [legacyNonceSize]byte
+}
+
+func (s *Session) headerSize() int {
+	switch {
+	case s == nil:
+		return frameSizeSize
+	case s.legacy != nil:
+		return legacyNonceSize + frameSizeSize
+	default:
+		return sealedFrameSizeSize
+	}
+}
+
+// sealFrame returns the bytes to send for dat.
+func (s *Session) sealFrame(dat []byte) ([]byte, error) {
+	var size [frameSizeSize]byte
+	switch {
+	case s == nil:
+		binary.BigEndian.PutUint32(size[:], uint32(len(dat)))
+		return append(size[:], dat...), nil
+	case s.legacy != nil:
+		var nonce [legacyNonceSize]byte
+		if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+			return nil, errors.Wrap(err, "failed to make nonce")
+		}
+		sealed := box.SealAfterPrecomputation(nil, dat, &nonce, s.legacy.RawPtr())
+		binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+		res := append(nonce[:], size[:]...)
+		return append(res, sealed...), nil
+	default:
+		binary.BigEndian.PutUint32(size[:], uint32(len(dat)+chacha20poly1305.Overhead))
+		res, err := s.send.seal(nil, size[:])
+		if err != nil {
+			return nil, err
+		}
+		return s.send.seal(res, dat)
+	}
+}
+
+// openHeader parses a frame header of headerSize bytes.
+func (s *Session) openHeader(raw []byte) (res frameHeader, err error) {
+	switch {
+	case s == nil:
+	case s.legacy != nil:
+		copy(res.nonce[:], raw)
+		raw = raw[legacyNonceSize:]
+	default:
+		if raw, err = s.recv.open(raw); err != nil {
+			return res, err
+		}
+	}
+	res.size = binary.BigEndian.Uint32(raw)
+	return res, nil
+}
+
+// openBody returns the message of a frame given its header.
+func (s *Session) openBody(header frameHeader, raw []byte) ([]byte, error) {
+	switch {
+	case s == nil:
+		return raw, nil
+	case s.legacy != nil:
+		res, ok := box.OpenAfterPrecomputation(nil, raw, &header.nonce, s.legacy.RawPtr())
+		if !ok {
+			return nil, errors.New("decrypt failed")
+		}
+		return res, nil
+	default:
+		return s.recv.open(raw)
+	}
+}
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Target is what a job builds for.
+type Target struct {
+	// Archs are the architectures of the job, such as arm64 and x86_64
+	Archs []string
+	// SDK is the name of the SDK the job builds against, such as iPhoneOS17.2, empty if it does not
+	// name one
+	SDK string
+}
+
+func (t Target) String() string {
+	res := strings.Join(t.Archs, ",")
+	if len(t.SDK) > 0 {
+		res += " " + t.SDK
+	}
+	return res
+}
+
+// NormalizeArch returns the Apple name of an architecture, so the spellings of Go, LLVM and triples
+// compare equal.
+func NormalizeArch(arch string) string {
+	switch arch {
+	case "amd64", "x86-64":
+		return "x86_64"
+	case "aarch64":
+		return "arm64"
+	case "aarch64_32":
+		return "arm64_32"
+	case "x86", "i486", "i586", "i686":
+		return "i386"
+	}
+	return arch
+}
+
+// tripleArch returns the architecture of a target triple like arm64-apple-ios17.0.
+func tripleArch(triple string) string {
+	arch, _, _ := strings.Cut(triple, "-")
+	return NormalizeArch(arch)
+}
+
+// sdkName returns the name of the SDK at path, like MacOSX14.2 for .../SDKs/MacOSX14.2.sdk.
+func sdkName(path string) string {
+	return strings.TrimSuffix(filepath.Base(filepath.Clean(path)), ".sdk")
+}
+
+// sdkPlatform returns an SDK name without its version, like MacOSX for MacOSX14.2.
+func sdkPlatform(name string) string {
+	return strings.TrimRight(name, "0123456789.")
+}
+
+// HasTarget returns whether the command names its architecture with -arch or -target.
+func (c *XcodeCmd) HasTarget() bool {
+	return len(c.GetTarget().Archs) > 0
+}
+
+// GetTarget returns the architectures and SDK the command builds for, as given by -arch, -target
+// and -isysroot.
+func (c *XcodeCmd) GetTarget() (res Target) {
+	c.walkFlagValues(func(name, value string) string {
+		switch name {
+		case "-arch":
+			res.Archs = append(res.Archs, NormalizeArch(value))
+		case "-target", "--target=":
+			res.Archs = append(res.Archs, tripleArch(value))
+		case "-isysroot":
+			res.SDK = sdkName(value)
+		}
+		return value
+	})
+	return res
+}
+
+// TargetSupported returns whether a server that builds for archs and has sdks can run a job for
+// target. Empty lists are from servers that do not say, which are assumed to build anything.
+func TargetSupported(archs, sdks []string, target Target) bool {
+	if len(archs) > 0 {
+		for _, arch := range target.Archs {
+			if !containsString(archs, arch) {
+				return false
+			}
+		}
+	}
+	if len(sdks) == 0 || len(target.SDK) == 0 {
+		return true
+	}
+	// an unversioned SDK, like the MacOSX.sdk link, is any version of its platform
+	unversioned := sdkPlatform(target.SDK) == target.SDK
+	for _, sdk := range sdks {
+		if sdk == target.SDK || (unversioned && sdkPlatform(sdk) == target.SDK) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
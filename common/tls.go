@@ -0,0 +1,94 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// loadCertPool reads a PEM file of CA certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read CA file")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(dat) {
+		return nil, errors.Errorf("no certificates in CA file: %s", path)
+	}
+	return pool, nil
+}
+
+// NewServerTLSConfig makes a TLS 1.3 config that presents the certificate in certFile and
+// keyFile. If clientCAFile is not empty, clients must present a certificate signed by one of its
+// CAs.
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load server certificate")
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+	}
+	if len(clientCAFile) > 0 {
+		if config.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// NewClientTLSConfig makes a TLS 1.3 config that verifies servers against the CAs in caFile, or
+// the system roots if it is empty, and presents the certificate in certFile and keyFile if they
+// are set. serverName overrides the name checked against the server certificate.
+func NewClientTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		ServerName: serverName,
+	}
+	var err error
+	if len(caFile) > 0 {
+		if config.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// DialTLS connects to address and completes a TLS handshake with config.
+func DialTLS(address string, config *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: handshakeTimeout}
+	config = config.Clone()
+	if len(config.ServerName) == 0 {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid address: %s", address)
+		}
+		config.ServerName = host
+	}
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "TLS handshake with %s failed", address)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
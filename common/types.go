@@ -3,35 +3,97 @@ package common
 import "github.com/vmihailenco/msgpack/v5"
 
 type Cmd struct {
+	ID   uint64
 	Name string
 	Args msgpack.RawMessage
 }
 
 type CmdResponse struct {
-	Success  bool
-	ErrorMsg *string
-	Payload  msgpack.RawMessage
+	ID        uint64
+	Success   bool
+	ErrorMsg  *string
+	ErrorCode string
+	Payload   msgpack.RawMessage
 }
 
+// Error codes let clients tell failures of the job itself apart from failures of the server.
+const (
+	// ErrorCodeGeneric is only sent by servers that predate error codes, which report compiler
+	// failures this way
+	ErrorCodeGeneric    = ""
+	ErrorCodeServer     = "server"
+	ErrorCodeCompile    = "compile"
+	ErrorCodeQueueFull  = "queuefull"
+	ErrorCodeRateLimit  = "ratelimit"
+	ErrorCodePolicy     = "policy"
+	ErrorCodePermission = "permission"
+	ErrorCodeToolchain  = "toolchain"
+	// ErrorCodeMissingIncludes means headers the job refers to by digest are no longer stored, and
+	// need to be sent again
+	ErrorCodeMissingIncludes = "missingincludes"
+)
+
+// RPCError is an error reported by the remote end of an RPC.
+type RPCError struct {
+	Code string
+	Msg  string
+}
+
+func (e RPCError) Error() string {
+	return e.Msg
+}
+
+// ProtocolVersion is sent by clients so servers can keep serving older clients the way they
+// expect. Version 1 clients receive compiler failures as a CompileResponse with a non-zero
+// ExitCode instead of as an RPC error. Version 2 clients receive every file the compiler wrote in
+// Files, instead of only Object and Dep.
+const ProtocolVersion = 2
+
 const MethodCompile = "compile"
 
+// Commands carry their arguments in Args. Command holds the same arguments joined by spaces for
+// peers that predate Args. Compiler is the driver the client was invoked with, which picks the
+// server toolchain to run, and Fingerprint is its CompilerFingerprint, which the toolchain must
+// match.
 type CompileCmd struct {
-	Command  string
-	Code     []byte
-	Includes []IncludeData
+	Version     int
+	Dir         string
+	Compiler    string
+	Fingerprint string
+	Args        []string
+	Command     string
+	// Env is the compiler environment of the client, see CompilerEnvVars
+	Env         map[string]string
+	Code        []byte
+	Includes    []IncludeData
+	IncludeRefs []IncludeRef
+}
+
+// OutputFile is a file written by the compiler, at the path the client asked for.
+type OutputFile struct {
+	Path string
+	Data []byte
 }
 
 type CompileResponse struct {
-	Output string
-	Object []byte
-	Dep    []byte
+	Output   string
+	Object   []byte
+	Dep      []byte
+	Files    []OutputFile
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
 }
 
 const MethodPreprocess = "preprocess"
 
 type PreprocessCmd struct {
-	Dir     string
-	Command string
+	Dir         string
+	Compiler    string
+	Fingerprint string
+	Args        []string
+	Command     string
+	Env         map[string]string
 }
 
 type PreprocessResponse struct {
@@ -47,6 +109,7 @@ type StatusCmd struct{}
 type StatusJob struct {
 	SourceAddress string
 	Filename      string
+	Args          []string
 	Command       string
 	Mode          string
 }
@@ -60,9 +123,85 @@ type StatusResponse struct {
 	WorkerStatus []StatusWorker
 	QueuedJobs   []StatusJob
 	NumWorkers   int
+	CacheHits    int64
+	CacheMisses  int64
+	Admission    StatusAdmission
+	Toolchains   []StatusToolchain
+	// Targets are the architectures the server builds for, and SDKs the SDKs it has. Servers that
+	// predate them build anything.
+	Targets []string
+	SDKs    []string
+}
+
+// Supports returns whether the server can run a job for target.
+func (s StatusResponse) Supports(target Target) bool {
+	return TargetSupported(s.Targets, s.SDKs, target)
+}
+
+// StatusToolchain is a compiler the server can run.
+type StatusToolchain struct {
+	Name        string
+	Path        string
+	Version     string
+	Fingerprint string
+}
+
+// StatusAdmission counts connections and requests the server turned away.
+type StatusAdmission struct {
+	ConnLimit     int64
+	HandshakeFail int64
+	FrameTooLarge int64
+	IdleClosed    int64
+	RateLimited   int64
+}
+
+const MethodAgentRun = "agentrun"
+
+type AgentRunCmd struct {
+	Dir              string
+	Args             []string
+	Env              map[string]string
+	ColorDiagnostics bool
+}
+
+type AgentRunResponse struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+	Error    *string
 }
 
 type IncludeData struct {
 	Path string
 	Data string
 }
+
+// IncludeRef names a header previously uploaded with MethodUploadIncludes by the digest of its
+// contents.
+type IncludeRef struct {
+	Path   string
+	Digest string
+}
+
+type IncludeBlob struct {
+	Digest string
+	Data   string
+}
+
+const MethodCheckIncludes = "checkincludes"
+
+type CheckIncludesCmd struct {
+	Digests []string
+}
+
+type CheckIncludesResponse struct {
+	Missing []string
+}
+
+const MethodUploadIncludes = "uploadincludes"
+
+type UploadIncludesCmd struct {
+	Blobs []IncludeBlob
+}
+
+type UploadIncludesResponse struct{}
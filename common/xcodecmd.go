@@ -10,21 +10,66 @@ import (
 
 type XcodeCmd struct {
 	toks []string
+	dir  string
+	env  map[string]string
 }
 
-func NewXcodeCmd(cmd string) *XcodeCmd {
+func NewXcodeCmd(args []string) *XcodeCmd {
+	toks := make([]string, len(args))
+	copy(toks, args)
+	return &XcodeCmd{
+		toks: toks,
+	}
+}
+
+// NewXcodeCmdFromString splits a space-joined command. It is only for peers that predate sending
+// argument arrays, and breaks on arguments that contain spaces.
+func NewXcodeCmdFromString(cmd string) *XcodeCmd {
 	return &XcodeCmd{
 		toks: strings.Split(cmd, " "),
 	}
 }
 
+// NewXcodeCmdFromWire builds a command from the Args of a protocol message, or from its
+// space-joined Command if the peer only sent that.
+func NewXcodeCmdFromWire(args []string, cmd string) *XcodeCmd {
+	if len(args) > 0 {
+		return NewXcodeCmd(args)
+	}
+	return NewXcodeCmdFromString(cmd)
+}
+
 func (c *XcodeCmd) Clone() *XcodeCmd {
 	ret := new(XcodeCmd)
 	ret.toks = make([]string, len(c.toks))
 	copy(ret.toks, c.toks)
+	ret.dir = c.dir
+	ret.env = c.env
 	return ret
 }
 
+// SetDir sets the working directory the command runs in. Relative paths in the command are
+// resolved against it, or against the process working directory if it is empty.
+func (c *XcodeCmd) SetDir(dir string) {
+	c.dir = dir
+}
+
+func (c *XcodeCmd) GetDir() string {
+	return c.dir
+}
+
+func (c *XcodeCmd) AbsPath(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path), nil
+	}
+	if len(c.dir) == 0 {
+		return filepath.Abs(path)
+	}
+	return filepath.Join(c.dir, path), nil
+}
+
+// GetCommand returns the space-joined command, as understood by peers that predate sending
+// argument arrays.
 func (c *XcodeCmd) GetCommand() string {
 	return strings.Join(c.toks, " ")
 }
@@ -33,6 +78,14 @@ func (c *XcodeCmd) GetTokens() []string {
 	return c.toks
 }
 
+// GetNormalizedTokens returns the command tokens without the compiler, suitable for use in cache
+// keys.
+func (c *XcodeCmd) GetNormalizedTokens() (res []string) {
+	ncmd := c.Clone()
+	ncmd.StripCompiler()
+	return ncmd.toks
+}
+
 func (c *XcodeCmd) getSwitchWithArg(name string) (string, error) {
 	for index, tok := range c.toks {
 		if tok == name && index < len(c.toks)-1 {
@@ -60,12 +113,25 @@ func (c *XcodeCmd) removeSwitch(name string, hasArg bool) {
 	}
 }
 
+// inputIndex returns the index of the single positional input in the command tokens.
+func (c *XcodeCmd) inputIndex() (int, error) {
+	flags := c.ClassifyFlags()
+	switch len(flags.InputIndexes) {
+	case 0:
+		return 0, errors.New("no input filepath")
+	case 1:
+		return flags.InputIndexes[0], nil
+	default:
+		return 0, errors.New("multiple input filepaths")
+	}
+}
+
 func (c *XcodeCmd) GetInputFilepath() (string, error) {
-	arg, err := c.getSwitchWithArg("-c")
+	index, err := c.inputIndex()
 	if err != nil {
-		return "", errors.Wrap(err, "no input filepath option")
+		return "", err
 	}
-	return arg, nil
+	return c.toks[index], nil
 }
 
 func (c *XcodeCmd) GetOutputFilepath() (string, error) {
@@ -85,8 +151,11 @@ func (c *XcodeCmd) GetDepFilepath() (string, error) {
 }
 
 func (c *XcodeCmd) SetInputFilepath(filepath string) {
-	c.removeSwitch("-c", true)
-	c.addSwitchWithArg("-c", filepath)
+	if index, err := c.inputIndex(); err == nil {
+		c.toks[index] = filepath
+		return
+	}
+	c.toks = append(c.toks, filepath)
 }
 
 func (c *XcodeCmd) SetOutputFilepath(filepath string) {
@@ -104,7 +173,9 @@ func (c *XcodeCmd) RemoveOutputFilepath() {
 }
 
 func (c *XcodeCmd) RemoveInputFilepath() {
-	c.removeSwitch("-c", true)
+	if index, err := c.inputIndex(); err == nil {
+		c.toks = append(c.toks[:index], c.toks[index+1:]...)
+	}
 }
 
 func (c *XcodeCmd) RemoveDepFilepath() {
@@ -115,6 +186,18 @@ func (c *XcodeCmd) SetPreprocessorOnly() {
 	c.toks = append(c.toks, "-E")
 }
 
+// SetColorDiagnostics asks the compiler for colored diagnostics, unless the command already says
+// otherwise. Remote compilers never see a terminal, so they will not color output on their own.
+func (c *XcodeCmd) SetColorDiagnostics() {
+	for _, tok := range c.toks {
+		if strings.HasPrefix(tok, "-fcolor-diagnostics") || strings.HasPrefix(tok, "-fno-color-diagnostics") ||
+			strings.HasPrefix(tok, "-fdiagnostics-color") || strings.HasPrefix(tok, "-fno-diagnostics-color") {
+			return
+		}
+	}
+	c.toks = append(c.toks, "-fcolor-diagnostics")
+}
+
 func (c *XcodeCmd) SetArch(arch string) {
 	switch arch {
 	case "amd64":
@@ -132,9 +215,62 @@ func (c *XcodeCmd) GetArch() string {
 	return arg
 }
 
+// compilerDrivers are the driver names we distribute. The driver picks the default language of
+// inputs like .c and .m, so a job runs with the same one remotely.
+var compilerDrivers = map[string]bool{
+	"cc":      true,
+	"c++":     true,
+	"gcc":     true,
+	"g++":     true,
+	"clang":   true,
+	"clang++": true,
+}
+
+// IsCompilerDriver returns whether name is the file name of a compiler driver we distribute.
+func IsCompilerDriver(name string) bool {
+	return compilerDrivers[name]
+}
+
+func (c *XcodeCmd) hasCompiler() bool {
+	return len(c.toks) > 0 && (strings.Contains(c.toks[0], "Xcode") || strings.Contains(c.toks[0], "bin/clang") ||
+		strings.Contains(c.toks[0], "bin/c++") || IsCompilerDriver(filepath.Base(c.toks[0])))
+}
+
+// GetCompiler returns the compiler the command was invoked with, or the default compiler if the
+// command does not start with one.
+func (c *XcodeCmd) GetCompiler() string {
+	if c.hasCompiler() {
+		return c.toks[0]
+	}
+	return DefaultCXX
+}
+
+// GetDriver returns the file name of the compiler the command was invoked with, such as clang or
+// c++.
+func (c *XcodeCmd) GetDriver() string {
+	return filepath.Base(c.GetCompiler())
+}
+
+// PreprocessesInput returns whether the compiler runs the input through the preprocessor, which
+// it does for everything but plain assembly.
+func (c *XcodeCmd) PreprocessesInput() bool {
+	if lang, err := c.getSwitchWithArg("-x"); err == nil {
+		return lang != "assembler"
+	}
+	for _, tok := range c.toks {
+		if strings.HasPrefix(tok, "-x") && len(tok) > 2 {
+			return tok[2:] != "assembler"
+		}
+	}
+	input, err := c.GetInputFilepath()
+	if err != nil {
+		return true
+	}
+	return filepath.Ext(input) != ".s"
+}
+
 func (c *XcodeCmd) StripCompiler() {
-	if strings.Contains(c.toks[0], "Xcode") || strings.Contains(c.toks[0], "bin/clang") ||
-		strings.Contains(c.toks[0], "bin/c++") {
+	if c.hasCompiler() {
 		c.toks = c.toks[1:]
 	}
 }
@@ -163,7 +299,7 @@ func (c *XcodeCmd) IncludeDirs() (res []string) {
 		} else {
 			return
 		}
-		dir, err := filepath.Abs(relpath)
+		dir, err := c.AbsPath(relpath)
 		if err != nil {
 			return
 		}
@@ -175,14 +311,14 @@ func (c *XcodeCmd) IncludeDirs() (res []string) {
 func (c *XcodeCmd) LocalizeIncludeDirs(basedir string) {
 	c.walkIncludeDirs(func(includeTyp string, tokIndex, numToks int) {
 		if numToks == 2 {
-			abspath, err := filepath.Abs(c.toks[tokIndex+1])
+			abspath, err := c.AbsPath(c.toks[tokIndex+1])
 			if err != nil {
 				return
 			}
 			c.toks[tokIndex+1] = basedir + abspath
 		} else if numToks == 1 {
 			relpath := c.toks[tokIndex][len(includeTyp):]
-			abspath, err := filepath.Abs(relpath)
+			abspath, err := c.AbsPath(relpath)
 			if err != nil {
 				return
 			}
@@ -191,6 +327,43 @@ func (c *XcodeCmd) LocalizeIncludeDirs(basedir string) {
 	})
 }
 
+// prefixMapFlags are the flags that remap path prefixes in compiler output, in the form
+// flag=old=new.
+var prefixMapFlags = []string{
+	"-ffile-prefix-map=",
+	"-fdebug-prefix-map=",
+	"-fmacro-prefix-map=",
+	"-fcoverage-prefix-map=",
+}
+
+// LocalizePrefixMaps moves the old side of absolute prefix maps under basedir, to match
+// LocalizeIncludeDirs.
+func (c *XcodeCmd) LocalizePrefixMaps(basedir string) {
+	for index, tok := range c.toks {
+		for _, flag := range prefixMapFlags {
+			if !strings.HasPrefix(tok, flag) {
+				continue
+			}
+			mapping := tok[len(flag):]
+			if filepath.IsAbs(mapping) {
+				c.toks[index] = flag + basedir + mapping
+			}
+		}
+	}
+}
+
+// AddFilePrefixMap maps paths starting with from to start with to instead, in debug info and
+// macros like __FILE__. It goes before any prefix maps already in the command, so those still
+// win for paths they match, whichever order the compiler applies them in.
+func (c *XcodeCmd) AddFilePrefixMap(from, to string) {
+	index := 0
+	if c.hasCompiler() {
+		index = 1
+	}
+	c.toks = append(c.toks[:index], append([]string{"-ffile-prefix-map=" + from + "=" + to},
+		c.toks[index:]...)...)
+}
+
 func (c *XcodeCmd) PushIncludeDirBack(path string) {
 	c.addSwitchWithArg("-I", path)
 }
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/tls"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"mmaxim.org/xcdistcc/common"
+)
+
+type ListenerOptions struct {
+	// MaxFrameSize is the largest message accepted from a client in bytes, 0 for the default
+	MaxFrameSize int
+	// MaxUnauthFrameSize is the largest message accepted from a client that has not authenticated,
+	// such as on plaintext and legacy handshake connections, 0 for the default
+	MaxUnauthFrameSize int
+	// HandshakeTimeout is how long a client has to finish the handshake, 0 for the default
+	HandshakeTimeout time.Duration
+	// IdleTimeout closes connections that have had no commands in flight for this long, 0 disables
+	IdleTimeout time.Duration
+	// MaxConnsPerIP caps the open connections from one address, 0 disables
+	MaxConnsPerIP int
+	// RequestRate is the sustained commands per second allowed from one address, with bursts of up
+	// to RequestBurst, 0 disables
+	RequestRate  float64
+	RequestBurst int
+	// TLS, if set, makes clients connect with TLS instead of the key pair handshake. Clients are
+	// identified by their certificate's common name when it requires client certificates.
+	TLS *tls.Config
+	// AllowLegacyClients accepts clients that only know the handshake without key confirmation or
+	// forward secrecy, when there are no authorized keys
+	AllowLegacyClients bool
+}
+
+const (
+	defaultHandshakeTimeout   = 10 * time.Second
+	defaultMaxUnauthFrameSize = 32 * 1024 * 1024
+)
+
+func (o ListenerOptions) withDefaults() ListenerOptions {
+	if o.MaxFrameSize <= 0 {
+		o.MaxFrameSize = common.DefaultMaxFrameSize
+	}
+	if o.MaxUnauthFrameSize <= 0 {
+		o.MaxUnauthFrameSize = defaultMaxUnauthFrameSize
+	}
+	if o.MaxUnauthFrameSize > o.MaxFrameSize {
+		o.MaxUnauthFrameSize = o.MaxFrameSize
+	}
+	if o.HandshakeTimeout <= 0 {
+		o.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	if o.RequestRate > 0 && o.RequestBurst <= 0 {
+		o.RequestBurst = int(math.Ceil(o.RequestRate))
+	}
+	return o
+}
+
+// tokenBucket allows rate events per second on average, and up to burst at once.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+type admissionPeer struct {
+	conns    int
+	requests *tokenBucket
+}
+
+// admission tracks the connections and request rate of each client address, and counts what it
+// turns away.
+type admission struct {
+	sync.Mutex
+	opts  ListenerOptions
+	peers map[string]*admissionPeer
+	stats common.StatusAdmission
+}
+
+func newAdmission(opts ListenerOptions) *admission {
+	return &admission{
+		opts:  opts,
+		peers: make(map[string]*admissionPeer),
+	}
+}
+
+func peerHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// prune drops peers with no connections whose rate limit has fully recovered, so they are no
+// different from a peer never seen.
+func (a *admission) prune(now time.Time) {
+	for host, peer := range a.peers {
+		if peer.conns == 0 && (peer.requests == nil || peer.requests.full(now)) {
+			delete(a.peers, host)
+		}
+	}
+}
+
+// acquire admits a new connection from host, unless it would go over the per address cap.
+func (a *admission) acquire(host string) bool {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	a.prune(now)
+	peer, ok := a.peers[host]
+	if !ok {
+		peer = &admissionPeer{}
+		if a.opts.RequestRate > 0 {
+			peer.requests = newTokenBucket(a.opts.RequestRate, a.opts.RequestBurst, now)
+		}
+		a.peers[host] = peer
+	}
+	if a.opts.MaxConnsPerIP > 0 && peer.conns >= a.opts.MaxConnsPerIP {
+		a.stats.ConnLimit++
+		return false
+	}
+	peer.conns++
+	return true
+}
+
+func (a *admission) release(host string) {
+	a.Lock()
+	defer a.Unlock()
+	if peer, ok := a.peers[host]; ok {
+		peer.conns--
+	}
+}
+
+// allowRequest reports whether host is within its request rate.
+func (a *admission) allowRequest(host string) bool {
+	a.Lock()
+	defer a.Unlock()
+	peer, ok := a.peers[host]
+	if !ok || peer.requests == nil {
+		return true
+	}
+	if !peer.requests.take(time.Now()) {
+		a.stats.RateLimited++
+		return false
+	}
+	return true
+}
+
+func (a *admission) count(counter *int64) {
+	a.Lock()
+	defer a.Unlock()
+	*counter++
+}
+
+func (a *admission) getStats() common.StatusAdmission {
+	a.Lock()
+	defer a.Unlock()
+	return a.stats
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mmaxim.org/xcdistcc/common"
+)
+
+// AuthorizedKeys maps the client public keys allowed to use the server to their names.
+type AuthorizedKeys map[common.PublicKey]string
+
+// LoadAuthorizedKeys reads a file with one hex public key per line, optionally followed by a name
+// for the client. Blank lines and lines starting with # are ignored.
+func LoadAuthorizedKeys(path string) (AuthorizedKeys, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open authorized keys")
+	}
+	defer file.Close()
+	res := make(AuthorizedKeys)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		key, err := common.NewPublicKeyFromString(fields[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid authorized key on line %d", lineNum)
+		}
+		name := key.String()
+		if len(fields) > 1 {
+			name = strings.Join(fields[1:], " ")
+		}
+		res[key] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read authorized keys")
+	}
+	return res, nil
+}
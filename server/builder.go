@@ -1,10 +1,14 @@
 package server
 
 import (
+	"bytes"
+	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/pkg/errors"
 	"mmaxim.org/xcdistcc/client"
@@ -33,84 +37,197 @@ func (e compileError) Error() string {
 
 // =============================================================================
 
+// BuilderOptions configure how a Builder runs jobs.
+type BuilderOptions struct {
+	// Limits bound the files each compile job may ship
+	Limits JobLimits
+	// Roots confine remote preprocessing
+	Roots SourceRoots
+	// Sandbox isolates the compiler
+	Sandbox SandboxOptions
+	// Toolchains are the compilers to run, common.DefaultCXX if nil
+	Toolchains *Toolchains
+}
+
 type Builder struct {
 	*common.LabelLogger
 
 	preprocessor *client.ClangPreprocessor
+	toolchains   *Toolchains
+	limits       JobLimits
+	roots        SourceRoots
+	sandbox      *sandbox
 }
 
-func NewBuilder(logger common.Logger) *Builder {
+func NewBuilder(opts BuilderOptions, logger common.Logger) (*Builder, error) {
+	sandbox, err := newSandbox(opts.Sandbox)
+	if err != nil {
+		return nil, err
+	}
+	toolchains := opts.Toolchains
+	if toolchains == nil {
+		if toolchains, err = NewToolchains(nil); err != nil {
+			return nil, err
+		}
+	}
 	return &Builder{
 		LabelLogger:  common.NewLabelLogger("Builder", logger),
 		preprocessor: client.NewClangPreprocessor(logger),
-	}
+		toolchains:   toolchains,
+		limits:       opts.Limits.withDefaults(),
+		roots:        opts.Roots,
+		sandbox:      sandbox,
+	}, nil
 }
 
-func (b *Builder) Compile(code []byte, cmd *common.XcodeCmd, includes []common.IncludeData) (res common.CompileResponse, err error) {
+// makeJobDir makes a temp directory for a job, which the caller removes.
+func makeJobDir() (string, error) {
 	owndir, err := common.RandString("xc", 9)
 	if err != nil {
-		return res, errors.Wrap(err, "failed to generate build dir name")
+		return "", errors.Wrap(err, "failed to generate build dir name")
 	}
-	// make temp directory for our job
 	dir := filepath.Join(os.TempDir(), owndir)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return res, errors.Wrap(err, "failed to make temp dir")
+		return "", errors.Wrap(err, "failed to make temp dir")
+	}
+	// the compiler sees the real path of its working directory, which on macOS is not the one
+	// TempDir returns
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", errors.Wrap(err, "failed to resolve temp dir")
+	}
+	return real, nil
+}
+
+// sandboxCommand returns a command that runs compiler for a job in dir, in the sandbox if there is
+// one. The caller runs cleanup once the command is done.
+func (b *Builder) sandboxCommand(dir, workdir, compiler string, cmd *common.XcodeCmd,
+	readOnly []string) (ecmd *sandboxCmd, cleanup func(), err error) {
+	cleanup = func() {}
+	root := sandboxRoot(dir)
+	if b.sandbox != nil {
+		if err := os.Mkdir(root, 0700); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to make sandbox dir")
+		}
+		cleanup = func() { os.Remove(root) }
+	}
+	if ecmd, err = b.sandbox.command(root, dir, workdir, compiler, cmd.GetTokens(), cmd.Environ(), readOnly); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return ecmd, cleanup, nil
+}
+
+func (b *Builder) Compile(compiler string, code []byte, cmd *common.XcodeCmd, includes []common.IncludeData) (res common.CompileResponse, err error) {
+	dir, err := makeJobDir()
+	if err != nil {
+		return res, err
 	}
 	defer os.RemoveAll(dir)
 	ccmd := cmd.Clone()
+	if len(ccmd.GetDir()) == 0 {
+		// clients that predate sending their working directory get a made up one
+		ccmd.SetDir("/")
+	}
+
+	// the job dir mirrors the client's filesystem, and the compiler runs in the mirror of the
+	// client's working directory, so every path the compiler writes maps back to a client path
+	mirror := func(path string) string {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(ccmd.GetDir(), path)
+		}
+		return filepath.Join(dir, path)
+	}
+	// debug info and __FILE__ get client paths from the compiler itself, anything else that names
+	// the job dir is rewritten below
+	ccmd.LocalizePrefixMaps(dir)
+	ccmd.AddFilePrefixMap(dir, "")
+	workdir := mirror(ccmd.GetDir())
+	if !withinDir(dir, workdir) {
+		return res, newPolicyError("working directory outside of the job directory: %s", ccmd.GetDir())
+	}
+	if err := os.MkdirAll(workdir, 0755); err != nil {
+		return res, errors.Wrap(err, "failed to make working dir")
+	}
+	materializer := newMaterializer(dir, b.limits)
 
 	// write out temp input file with same name
 	origInputPath, err := cmd.GetInputFilepath()
 	if err != nil {
 		return res, err
 	}
-	inputFilepath := filepath.Join(dir, filepath.Base(origInputPath))
-	if err := os.WriteFile(inputFilepath, code, 0644); err != nil {
+	clientInputPath := origInputPath
+	if !filepath.IsAbs(clientInputPath) {
+		clientInputPath = filepath.Join(ccmd.GetDir(), clientInputPath)
+	}
+	inputFilepath, err := materializer.write(clientInputPath, code)
+	if err != nil {
 		return res, errors.Wrap(err, "failed to write input file")
 	}
-	ccmd.RemoveInputFilepath()
 	ccmd.SetInputFilepath(inputFilepath)
 
 	origOutputPath, err := cmd.GetOutputFilepath()
 	if err != nil {
 		return res, err
 	}
-	outputFilepath := filepath.Join(dir, filepath.Base(origOutputPath))
-	ccmd.RemoveOutputFilepath()
-	ccmd.SetOutputFilepath(outputFilepath)
-
+	outputFilepath := mirror(origOutputPath)
 	var depFilepath string
-	origDepPath, err := cmd.GetDepFilepath()
-	if err == nil {
-		depFilepath = filepath.Join(dir, filepath.Base(origDepPath))
-		ccmd.RemoveDepFilepath()
-		ccmd.SetDepFilepath(depFilepath)
+	if origDepPath, err := cmd.GetDepFilepath(); err == nil {
+		depFilepath = mirror(origDepPath)
+	}
+	for _, path := range cmd.OutputPaths() {
+		if !withinDir(dir, mirror(path)) {
+			return res, newPolicyError("output outside of the job directory: %s", path)
+		}
+	}
+	ccmd.RelocateOutputPaths(mirror)
+	for _, path := range ccmd.OutputPaths() {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return res, errors.Wrap(err, "failed to make output dir")
+		}
 	}
 
 	// if we have include data, create the localized version of it in the temp dir, and change the
 	// compile commands be rooted in it
+	var includeDir string
 	if len(includes) != 0 {
 		for _, include := range includes {
-			dest := dir + include.Path
-			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
-				b.Debug("failed to make include dirs: dest: %s err: %s", dest, err)
-				continue
-			}
-			if err := os.WriteFile(dest, []byte(include.Data), 0644); err != nil {
-				b.Debug("failed to write include: dest: %s err: %s", dest, err)
-				continue
+			if _, err := materializer.write(include.Path, []byte(include.Data)); err != nil {
+				return res, errors.Wrap(err, "failed to write include")
 			}
 		}
 		ccmd.LocalizeIncludeDirs(dir)
+		includeDir = dir
 	}
+	ccmd.SetEnv(jobEnv(compiler, ccmd, includeDir))
 
 	ccmd.StripCompiler()
 	//b.Debug("compile command: %s", ccmd.GetCommand())
-	ecmd := exec.Command(common.DefaultCXX, ccmd.GetTokens()...)
-	out, err := ecmd.CombinedOutput()
+	ecmd, cleanup, err := b.sandboxCommand(dir, workdir, compiler, ccmd, nil)
 	if err != nil {
-		b.Debug("failed to run command: out: %s err: %s", out, err)
-		return res, newCompileError(err.Error(), string(out[:]))
+		return res, err
+	}
+	defer cleanup()
+	var stdout, stderr, combined bytes.Buffer
+	ecmd.Stdout = io.MultiWriter(&stdout, &combined)
+	ecmd.Stderr = io.MultiWriter(&stderr, &combined)
+	err = ecmd.Run()
+	res.Stdout = unmirror(dir, stdout.Bytes())
+	res.Stderr = unmirror(dir, stderr.Bytes())
+	res.Output = string(unmirror(dir, combined.Bytes()))
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return res, errors.Wrap(err, "failed to run compiler")
+		}
+		b.Debug("failed to run command: out: %s err: %s", res.Output, err)
+		res.ExitCode = exitErr.ExitCode()
+		// serialized diagnostics and the like are still wanted when the compile fails
+		if res.Files, err = b.collectOutputs(dir, materializer.written); err != nil {
+			return res, err
+		}
+		return res, newCompileError(exitErr.Error(), res.Output)
 	}
 
 	// read output file
@@ -125,35 +242,124 @@ func (b *Builder) Compile(code []byte, cmd *common.XcodeCmd, includes []common.I
 		if err != nil {
 			return res, errors.Wrap(err, "failed to read dep file")
 		}
-		// these files get our modified path in them, so replace that path with the original so they work on
-		// the host machine
-		res.Dep = []byte(strings.ReplaceAll(string(dep[:]), inputFilepath, origInputPath))
+		// these files get our modified path in them, so strip the job dir so they work on the host
+		// machine
+		res.Dep = unmirror(dir, dep)
 	}
-	res.Output = string(out)
 	res.Object = object
+	if res.Files, err = b.collectOutputs(dir, materializer.written); err != nil {
+		return res, err
+	}
 	return res, nil
 }
 
-func (b *Builder) Preprocess(dir string, cmd *common.XcodeCmd) (res common.PreprocessResponse, err error) {
-	b.preprocessor.SetDirectory(dir)
-	out, _, _, err := b.preprocessor.Preprocess(cmd)
+// unmirror rewrites paths in the job dir to the client paths they mirror.
+func unmirror(dir string, dat []byte) []byte {
+	return bytes.ReplaceAll(dat, []byte(dir), nil)
+}
+
+// isText guesses whether dat is a text file, such as a dep file or trace JSON, where paths can be
+// rewritten in place. Binary formats like objects and serialized diagnostics store string lengths,
+// so they rely on the prefix maps instead.
+func isText(dat []byte) bool {
+	return utf8.Valid(dat) && bytes.IndexByte(dat, 0) < 0
+}
+
+// collectOutputs returns every file under the job dir that the compiler wrote, at the path it has
+// on the client.
+func (b *Builder) collectOutputs(dir string, materialized map[string]bool) (res []common.OutputFile, err error) {
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || materialized[path] {
+			return nil
+		}
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if isText(dat) {
+			dat = unmirror(dir, dat)
+		}
+		res = append(res, common.OutputFile{
+			Path: strings.TrimPrefix(path, dir),
+			Data: dat,
+		})
+		return nil
+	})
 	if err != nil {
+		return nil, errors.Wrap(err, "failed to collect output files")
+	}
+	return res, nil
+}
+
+func (b *Builder) Preprocess(compiler, dir string, cmd *common.XcodeCmd) (res common.PreprocessResponse, err error) {
+	cmd.SetDir(dir)
+	cmd.SetEnv(jobEnv(compiler, cmd, ""))
+	var stderr bytes.Buffer
+	var out, dep []byte
+	if cmd.PreprocessesInput() {
+		out, dep, err = b.runPreprocessor(compiler, cmd, &stderr)
+	} else {
+		out, _, _, err = b.preprocessor.PreprocessWith(compiler, cmd, &stderr)
+	}
+	if err != nil {
+		// diagnostics quote the files they are about
+		if err := b.roots.checkDiagnostics(cmd, stderr.String()); err != nil {
+			return res, err
+		}
+		res.Output = stderr.String()
 		return res, err
 	}
+	// the sandbox only lets #embed see the source roots
+	if err := b.roots.checkPreprocessed(cmd, out, b.sandbox != nil); err != nil {
+		return res, err
+	}
+	res.Output = stderr.String()
 	res.Code = out
-	depFilepath, err := cmd.GetDepFilepath()
-	if err == nil {
-		var absDepFilepath string
-		if filepath.IsAbs(depFilepath) {
-			absDepFilepath = depFilepath
-		} else {
-			absDepFilepath = dir + string(filepath.Separator) + depFilepath
-		}
-		dep, err := os.ReadFile(absDepFilepath)
-		if err != nil {
-			return res, errors.Wrap(err, "failed to read dep file")
+	res.Dep = dep
+	return res, nil
+}
+
+// runPreprocessor preprocesses cmd, in the sandbox if there is one, with the source roots visible
+// read only. Files the preprocessor writes, like the dep file, go to a job dir instead of the
+// shared filesystem, and the dep file is returned.
+func (b *Builder) runPreprocessor(compiler string, cmd *common.XcodeCmd, stderr io.Writer) (out, dep []byte, err error) {
+	dir, err := makeJobDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+	mirror := func(path string) string {
+		if abspath, err := cmd.AbsPath(path); err == nil {
+			path = abspath
 		}
-		res.Dep = dep
+		return filepath.Join(dir, path)
 	}
-	return res, nil
+	precmd := client.PreprocessorCmd(cmd)
+	precmd.RelocateOutputPaths(mirror)
+	for _, path := range precmd.OutputPaths() {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to make output dir")
+		}
+	}
+	ecmd, cleanup, err := b.sandboxCommand(dir, cmd.GetDir(), compiler, precmd, b.roots)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cleanup()
+	var stdout bytes.Buffer
+	ecmd.Stdout = &stdout
+	ecmd.Stderr = stderr
+	if err := ecmd.Run(); err != nil {
+		b.Debug("preprocess failed: %s", err)
+		return nil, nil, errors.Wrap(err, "preprocess failed")
+	}
+	if depFilepath, err := cmd.GetDepFilepath(); err == nil {
+		if dep, err = os.ReadFile(mirror(depFilepath)); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to read dep file")
+		}
+	}
+	return stdout.Bytes(), dep, nil
 }
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"mmaxim.org/xcdistcc/common"
+)
+
+type lruEntry[T any] struct {
+	key  string
+	val  T
+	size int64
+}
+
+// lruCache is a size-bounded in-memory cache that evicts the least recently used entries first.
+type lruCache[T any] struct {
+	sync.Mutex
+	maxSize int64
+	size    int64
+	sizeFn  func(T) int64
+	entries map[string]*list.Element
+	lru     *list.List
+	hits    int64
+	misses  int64
+}
+
+func newLRUCache[T any](maxSize int64, sizeFn func(T) int64) *lruCache[T] {
+	return &lruCache[T]{
+		maxSize: maxSize,
+		sizeFn:  sizeFn,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *lruCache[T]) enabled() bool {
+	return c.maxSize > 0
+}
+
+func (c *lruCache[T]) get(key string) (res T, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return res, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*lruEntry[T]).val, true
+}
+
+func (c *lruCache[T]) has(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+func (c *lruCache[T]) put(key string, val T) {
+	size := c.sizeFn(val)
+	if size > c.maxSize {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&lruEntry[T]{
+		key:  key,
+		val:  val,
+		size: size,
+	})
+	c.size += size
+	for c.size > c.maxSize {
+		c.evictOldest()
+	}
+}
+
+func (c *lruCache[T]) evictOldest() {
+	elem := c.lru.Back()
+	if elem == nil {
+		return
+	}
+	entry := c.lru.Remove(elem).(*lruEntry[T])
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+func (c *lruCache[T]) stats() (hits, misses int64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.hits, c.misses
+}
+
+// =============================================================================
+
+type compileCache = lruCache[common.CompileResponse]
+
+func newCompileCache(maxSize int64) *compileCache {
+	return newLRUCache(maxSize, func(res common.CompileResponse) int64 {
+		size := int64(len(res.Object) + len(res.Dep) + len(res.Output) + len(res.Stdout) + len(res.Stderr))
+		for _, file := range res.Files {
+			size += int64(len(file.Path) + len(file.Data))
+		}
+		return size
+	})
+}
+
+func compileCacheKey(cmd *common.XcodeCmd, code []byte, includes []common.IncludeData,
+	compilerID string) string {
+	d := common.NewDigest()
+	d.AddString(compilerID)
+	// output paths in the response are resolved against the client's working directory
+	d.AddString(cmd.GetDir())
+	d.AddStrings(cmd.GetNormalizedTokens())
+	cmd.AddEnvToDigest(d)
+	d.AddBytes(code)
+	sorted := make([]common.IncludeData, len(includes))
+	copy(sorted, includes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+	d.AddCount(len(sorted))
+	for _, include := range sorted {
+		d.AddString(include.Path)
+		d.AddString(include.Data)
+	}
+	return d.String()
+}
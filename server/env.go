@@ -0,0 +1,74 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+
+	"mmaxim.org/xcdistcc/common"
+)
+
+// clientDeveloperDir returns the Developer dir of the Xcode the client ran, from DEVELOPER_DIR or
+// SDKROOT.
+func clientDeveloperDir(env map[string]string) (string, bool) {
+	if dir := env["DEVELOPER_DIR"]; len(dir) > 0 {
+		// xcode-select also takes the path of the app
+		if strings.HasSuffix(filepath.Clean(dir), ".app") {
+			dir = filepath.Join(dir, "Contents", "Developer")
+		}
+		return filepath.Clean(dir), true
+	}
+	if sdkroot := env["SDKROOT"]; filepath.IsAbs(sdkroot) {
+		return developerDir(sdkroot)
+	}
+	return "", false
+}
+
+// jobEnv returns the compiler environment of cmd translated to this server, for running compiler.
+// Paths in the client's Xcode move to the Xcode compiler is part of, and if the job's headers were
+// shipped to includeDir, the include path variables move under it like the include dirs of the
+// command.
+func jobEnv(compiler string, cmd *common.XcodeCmd, includeDir string) map[string]string {
+	env := cmd.GetEnv()
+	if env == nil {
+		return nil
+	}
+	translate := func(path string) string { return path }
+	clientDir, clientOK := clientDeveloperDir(env)
+	serverDir, serverOK := developerDir(filepath.Dir(compiler))
+	if clientOK && serverOK {
+		translate = func(path string) string {
+			if !filepath.IsAbs(path) || !withinDir(clientDir, path) {
+				return path
+			}
+			rel, _ := filepath.Rel(clientDir, path)
+			return filepath.Join(serverDir, rel)
+		}
+	}
+
+	res := make(map[string]string, len(env))
+	for name, value := range env {
+		res[name] = value
+	}
+	if sdkroot, ok := res["SDKROOT"]; ok {
+		res["SDKROOT"] = translate(sdkroot)
+	}
+	if _, ok := res["DEVELOPER_DIR"]; ok && clientOK && serverOK {
+		res["DEVELOPER_DIR"] = serverDir
+	}
+	for _, name := range common.IncludePathEnvVars {
+		value, ok := res[name]
+		if !ok {
+			continue
+		}
+		dirs := filepath.SplitList(value)
+		for index, dir := range dirs {
+			if len(includeDir) == 0 {
+				dirs[index] = translate(dir)
+			} else if abspath, err := cmd.AbsPath(dir); err == nil {
+				dirs[index] = includeDir + abspath
+			}
+		}
+		res[name] = strings.Join(dirs, string(filepath.ListSeparator))
+	}
+	return res
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"mmaxim.org/xcdistcc/common"
+)
+
+// missingIncludesError is returned for jobs that refer to headers the store does not have, which
+// can happen when other uploads evict them after the client checked.
+type missingIncludesError struct {
+	msg string
+}
+
+func newMissingIncludesError(format string, args ...interface{}) missingIncludesError {
+	return missingIncludesError{
+		msg: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e missingIncludesError) Error() string {
+	return e.msg
+}
+
+// includeStore holds shipped header contents keyed by their digest, so clients only need to
+// upload headers the server has not seen before.
+type includeStore struct {
+	*common.LabelLogger
+	blobs *lruCache[string]
+}
+
+func newIncludeStore(maxSize int64, logger common.Logger) *includeStore {
+	return &includeStore{
+		LabelLogger: common.NewLabelLogger("includeStore", logger),
+		blobs: newLRUCache(maxSize, func(dat string) int64 {
+			return int64(len(dat))
+		}),
+	}
+}
+
+func (s *includeStore) missing(digests []string) (res []string) {
+	for _, digest := range digests {
+		if !s.blobs.has(digest) {
+			res = append(res, digest)
+		}
+	}
+	return res
+}
+
+func (s *includeStore) add(blobs []common.IncludeBlob) error {
+	if !s.blobs.enabled() {
+		// clients send the headers with the job instead
+		return errors.New("include store is disabled")
+	}
+	for _, blob := range blobs {
+		if digest := common.DigestBytes([]byte(blob.Data)); digest != blob.Digest {
+			return fmt.Errorf("include digest mismatch: %s != %s", digest, blob.Digest)
+		}
+		s.blobs.put(blob.Digest, blob.Data)
+	}
+	return nil
+}
+
+func (s *includeStore) resolve(refs []common.IncludeRef) (res []common.IncludeData, err error) {
+	res = make([]common.IncludeData, 0, len(refs))
+	for _, ref := range refs {
+		dat, ok := s.blobs.get(ref.Digest)
+		if !ok {
+			return nil, newMissingIncludesError("missing include: %s", ref.Path)
+		}
+		res = append(res, common.IncludeData{
+			Path: ref.Path,
+			Data: dat,
+		})
+	}
+	return res, nil
+}
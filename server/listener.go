@@ -1,39 +1,60 @@
 package server
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/vmihailenco/msgpack/v5"
-	"golang.org/x/crypto/nacl/box"
 	"mmaxim.org/xcdistcc/common"
 )
 
+var errRateLimited = errors.New("request rate limit exceeded")
+
 type Listener struct {
 	*common.LabelLogger
-	runner     *Runner
-	address    string
-	keyPair    *common.KeyPair
-	listener   net.Listener
-	shutdownCh chan struct{}
+	runner         *Runner
+	address        string
+	keyPair        *common.KeyPair
+	authorizedKeys AuthorizedKeys
+	opts           ListenerOptions
+	admission      *admission
+	listener       net.Listener
+	shutdownCh     chan struct{}
 }
 
-func NewListener(runner *Runner, address string, keyPair *common.KeyPair, logger common.Logger) *Listener {
+// NewListener makes a listener for runner. If authorizedKeys is not nil, clients must
+// authenticate with one of them during the handshake.
+func NewListener(runner *Runner, address string, keyPair *common.KeyPair, authorizedKeys AuthorizedKeys,
+	opts ListenerOptions, logger common.Logger) *Listener {
+	opts = opts.withDefaults()
 	return &Listener{
-		LabelLogger: common.NewLabelLogger("Listener", logger),
-		runner:      runner,
-		address:     address,
-		keyPair:     keyPair,
-		shutdownCh:  make(chan struct{}),
+		LabelLogger:    common.NewLabelLogger("Listener", logger),
+		runner:         runner,
+		address:        address,
+		keyPair:        keyPair,
+		authorizedKeys: authorizedKeys,
+		opts:           opts,
+		admission:      newAdmission(opts),
+		shutdownCh:     make(chan struct{}),
 	}
 }
 
 func (r *Listener) Run() (err error) {
+	if r.opts.TLS != nil && (r.keyPair != nil || r.authorizedKeys != nil) {
+		return errors.New("TLS can not be used with a server key pair or authorized keys")
+	}
+	if r.authorizedKeys != nil && r.keyPair == nil {
+		return errors.New("authorized keys require a server key pair")
+	}
 	go r.signalHandler()
 	if r.listener, err = net.Listen("tcp", r.address); err != nil {
 		r.Debug("Run: failed to listen on address: %s", err)
@@ -44,6 +65,12 @@ func (r *Listener) Run() (err error) {
 	if r.keyPair != nil {
 		r.Debug("secure connection: public key: %s", r.keyPair.Public)
 	}
+	if r.opts.TLS != nil {
+		r.Debug("secure connection: TLS")
+	}
+	if r.authorizedKeys != nil {
+		r.Debug("authorized keys: %d", len(r.authorizedKeys))
+	}
 	for {
 		connCh := make(chan net.Conn)
 		errCh := make(chan error)
@@ -74,12 +101,95 @@ func (r *Listener) signalHandler() {
 	close(r.shutdownCh)
 }
 
-func (r *Listener) sendResponse(payload interface{}, err error, conn net.Conn, secret *common.SharedSecret) error {
-	var response common.CmdResponse
+// serverConn is the state for one client connection. Commands on it are handled concurrently, so
+// responses are serialized through sendMu.
+type serverConn struct {
+	conn     net.Conn
+	session  *common.Session
+	identity string
+	sendMu   sync.Mutex
+
+	activityMu sync.Mutex
+	inflight   int
+	lastActive time.Time
+}
+
+func newServerConn(conn net.Conn, session *common.Session, identity string) *serverConn {
+	return &serverConn{
+		conn:       conn,
+		session:    session,
+		identity:   identity,
+		lastActive: time.Now(),
+	}
+}
+
+func (c *serverConn) beginCommand() {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	c.inflight++
+	c.lastActive = time.Now()
+}
+
+func (c *serverConn) endCommand() {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	c.inflight--
+	c.lastActive = time.Now()
+}
+
+// idleFor returns how long the connection has had no commands in flight.
+func (c *serverConn) idleFor(now time.Time) time.Duration {
+	c.activityMu.Lock()
+	defer c.activityMu.Unlock()
+	if c.inflight > 0 {
+		return 0
+	}
+	return now.Sub(c.lastActive)
+}
+
+// source names the client for job status, by its authenticated identity if it has one.
+func (c *serverConn) source() string {
+	if len(c.identity) > 0 {
+		return c.identity
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+func errorCode(err error) string {
+	var cerr compileError
+	var perr policyError
+	var permErr permissionError
+	var tcErr toolchainError
+	var missingErr missingIncludesError
+	switch {
+	case errors.As(err, &cerr):
+		return common.ErrorCodeCompile
+	case errors.As(err, &perr):
+		return common.ErrorCodePolicy
+	case errors.As(err, &permErr):
+		return common.ErrorCodePermission
+	case errors.As(err, &tcErr):
+		return common.ErrorCodeToolchain
+	case errors.As(err, &missingErr):
+		return common.ErrorCodeMissingIncludes
+	case errors.Is(err, errQueueFull):
+		return common.ErrorCodeQueueFull
+	case errors.Is(err, errRateLimited):
+		return common.ErrorCodeRateLimit
+	default:
+		return common.ErrorCodeServer
+	}
+}
+
+func (r *Listener) sendResponse(id uint64, payload interface{}, err error, sconn *serverConn) error {
+	response := common.CmdResponse{
+		ID: id,
+	}
 	if err != nil {
 		response.Success = false
 		response.ErrorMsg = new(string)
 		*response.ErrorMsg = err.Error()
+		response.ErrorCode = errorCode(err)
 	} else {
 		response.Success = true
 		dat, err := msgpack.Marshal(payload)
@@ -94,64 +204,182 @@ func (r *Listener) sendResponse(payload interface{}, err error, conn net.Conn, s
 		r.Debug("sendResponse: failed to marshal response: %s", err)
 		return err
 	}
-	if err := common.RPCSendRaw(conn, dat, secret); err != nil {
+	sconn.sendMu.Lock()
+	defer sconn.sendMu.Unlock()
+	if err := common.RPCSendRaw(sconn.conn, dat, sconn.session); err != nil {
 		r.Debug("sendResponse: failed to send response: %s", err)
 		return err
 	}
 	return nil
 }
 
-func (r *Listener) handleCommand(cmd common.Cmd, conn net.Conn, secret *common.SharedSecret) error {
+func (r *Listener) handleCommand(cmd common.Cmd, sconn *serverConn) error {
 	switch cmd.Name {
 	case common.MethodCompile:
 		var compile common.CompileCmd
 		if err := msgpack.Unmarshal(cmd.Args, &compile); err != nil {
 			r.Debug("handleCommand: failed to parse compile args: %s", err)
-			return err
+			return r.sendResponse(cmd.ID, nil, err, sconn)
 		}
-		payload, err := r.runner.Compile(compile, "")
-		return r.sendResponse(payload, err, conn, secret)
+		payload, err := r.runner.Compile(compile, sconn.source())
+		return r.sendResponse(cmd.ID, payload, err, sconn)
 	case common.MethodPreprocess:
 		var preprocess common.PreprocessCmd
 		if err := msgpack.Unmarshal(cmd.Args, &preprocess); err != nil {
 			r.Debug("handleCommand: failed to parse preprocess args: %s", err)
-			return err
+			return r.sendResponse(cmd.ID, nil, err, sconn)
+		}
+		payload, err := r.runner.Preprocess(preprocess, sconn.source())
+		return r.sendResponse(cmd.ID, payload, err, sconn)
+	case common.MethodCheckIncludes:
+		var check common.CheckIncludesCmd
+		if err := msgpack.Unmarshal(cmd.Args, &check); err != nil {
+			r.Debug("handleCommand: failed to parse check includes args: %s", err)
+			return r.sendResponse(cmd.ID, nil, err, sconn)
 		}
-		payload, err := r.runner.Preprocess(preprocess, "")
-		return r.sendResponse(payload, err, conn, secret)
+		return r.sendResponse(cmd.ID, r.runner.CheckIncludes(check), nil, sconn)
+	case common.MethodUploadIncludes:
+		var upload common.UploadIncludesCmd
+		if err := msgpack.Unmarshal(cmd.Args, &upload); err != nil {
+			r.Debug("handleCommand: failed to parse upload includes args: %s", err)
+			return r.sendResponse(cmd.ID, nil, err, sconn)
+		}
+		payload, err := r.runner.UploadIncludes(upload)
+		return r.sendResponse(cmd.ID, payload, err, sconn)
 	case common.MethodStatus:
-		return r.sendResponse(r.runner.Status(), nil, conn, secret)
+		status := r.runner.Status()
+		status.Admission = r.admission.getStats()
+		return r.sendResponse(cmd.ID, status, nil, sconn)
 	default:
 		r.Debug("handleCommand: unknown command: %s", cmd.Name)
-		return errors.New("unknown command")
+		return r.sendResponse(cmd.ID, nil, fmt.Errorf("unknown command: %s", cmd.Name), sconn)
 	}
 }
 
-func (r *Listener) handshake(conn net.Conn) (res *common.SharedSecret, err error) {
-	var out [32]byte
-	if _, err := io.ReadFull(conn, out[:]); err != nil {
-		return nil, err
+// authorize checks a client key presented during the handshake against the authorized keys.
+func (r *Listener) authorize(client *common.PublicKey) error {
+	if r.authorizedKeys == nil {
+		return nil
+	}
+	if client == nil {
+		return errors.New("client did not present a key")
 	}
-	pk := common.NewPublicKey(out)
-	box.Precompute(&out, pk.RawPtr(), r.keyPair.Private.RawPtr())
-	secret := common.NewSharedSecret(out)
-	return &secret, nil
+	if _, ok := r.authorizedKeys[*client]; !ok {
+		return fmt.Errorf("key not authorized: %s", client)
+	}
+	return nil
+}
+
+// identify names an authenticated client, by its authorized keys entry if there is one.
+func (r *Listener) identify(client *common.PublicKey) string {
+	if client == nil {
+		return ""
+	}
+	if name, ok := r.authorizedKeys[*client]; ok {
+		return name
+	}
+	return client.String()
+}
+
+// watchIdle closes the connection once it has been idle for the idle timeout, until doneCh is
+// closed.
+func (r *Listener) watchIdle(sconn *serverConn, doneCh chan struct{}) {
+	ticker := time.NewTicker(r.opts.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-doneCh:
+			return
+		case now := <-ticker.C:
+			if sconn.idleFor(now) >= r.opts.IdleTimeout {
+				r.Debug("watchIdle: closing idle connection: %s", sconn.conn.RemoteAddr())
+				r.admission.count(&r.admission.stats.IdleClosed)
+				sconn.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (r *Listener) handshake(conn net.Conn) (res common.HandshakeResult, err error) {
+	conn.SetDeadline(time.Now().Add(r.opts.HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	// the legacy handshake can not authenticate clients
+	allowLegacy := r.opts.AllowLegacyClients && r.authorizedKeys == nil
+	return common.ServerHandshake(conn, *r.keyPair, allowLegacy, r.authorize)
+}
+
+// tlsHandshake runs the TLS handshake on conn, and returns the TLS connection and the client's
+// certificate name if it presented one.
+func (r *Listener) tlsHandshake(conn net.Conn) (*tls.Conn, string, error) {
+	tlsConn := tls.Server(conn, r.opts.TLS)
+	tlsConn.SetDeadline(time.Now().Add(r.opts.HandshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, "", err
+	}
+	var identity string
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		identity = certs[0].Subject.CommonName
+	}
+	return tlsConn, identity, nil
 }
 
 func (r *Listener) serve(conn net.Conn) {
 	defer conn.Close()
-	var err error
-	var sharedSecret *common.SharedSecret
-	if r.keyPair != nil {
-		if sharedSecret, err = r.handshake(conn); err != nil {
-			r.Debug("serve: failed handshake: %s", err)
+	host := peerHost(conn.RemoteAddr())
+	if !r.admission.acquire(host) {
+		r.Debug("serve: too many connections from %s", host)
+		return
+	}
+	defer r.admission.release(host)
+	var session *common.Session
+	var identity string
+	// handshake messages have fixed sizes, so until a client authenticates only its frames need a
+	// limit of their own
+	maxFrameSize := r.opts.MaxUnauthFrameSize
+	if r.opts.TLS != nil {
+		tlsConn, name, err := r.tlsHandshake(conn)
+		if err != nil {
+			r.Debug("serve: failed TLS handshake from %s: %s", conn.RemoteAddr(), err)
+			r.admission.count(&r.admission.stats.HandshakeFail)
+			return
+		}
+		conn = tlsConn
+		identity = name
+		if len(identity) > 0 {
+			r.Debug("serve: authenticated %s as %s", conn.RemoteAddr(), identity)
+			maxFrameSize = r.opts.MaxFrameSize
+		}
+	} else if r.keyPair != nil {
+		res, err := r.handshake(conn)
+		if err != nil {
+			r.Debug("serve: failed handshake from %s: %s", conn.RemoteAddr(), err)
+			r.admission.count(&r.admission.stats.HandshakeFail)
 			return
 		}
+		session = res.Session
+		identity = r.identify(res.Client)
+		if len(identity) > 0 {
+			r.Debug("serve: authenticated %s as %s", conn.RemoteAddr(), identity)
+		}
+		if r.authorizedKeys != nil && !res.Legacy {
+			maxFrameSize = r.opts.MaxFrameSize
+		}
+	}
+	sconn := newServerConn(conn, session, identity)
+	if r.opts.IdleTimeout > 0 {
+		doneCh := make(chan struct{})
+		defer close(doneCh)
+		go r.watchIdle(sconn, doneCh)
 	}
 	for {
-		dat, err := common.RPCRecvRaw(conn, sharedSecret)
+		dat, err := common.RPCRecvRaw(conn, session, maxFrameSize)
 		if err != nil {
-			if errors.Unwrap(err) == io.EOF {
+			if errors.Is(err, common.ErrFrameTooLarge) {
+				r.Debug("serve: dropping %s: %s", conn.RemoteAddr(), err)
+				r.admission.count(&r.admission.stats.FrameTooLarge)
+			} else if errors.Unwrap(err) == io.EOF {
 				r.Debug("serve: failed to recv: %s", err)
 			}
 			return
@@ -161,9 +389,21 @@ func (r *Listener) serve(conn net.Conn) {
 			r.Debug("serve: invalid msgpack: %s", err)
 			return
 		}
-		if err := r.handleCommand(cmd, conn, sharedSecret); err != nil {
-			r.Debug("serve: failed to handle command: %s", err)
-			return
-		}
+		allowed := r.admission.allowRequest(host)
+		sconn.beginCommand()
+		go func() {
+			defer sconn.endCommand()
+			var err error
+			if allowed {
+				err = r.handleCommand(cmd, sconn)
+			} else {
+				r.Debug("serve: rate limited %s: %s", conn.RemoteAddr(), cmd.Name)
+				err = r.sendResponse(cmd.ID, nil, errRateLimited, sconn)
+			}
+			if err != nil {
+				r.Debug("serve: failed to handle command: %s", err)
+				conn.Close()
+			}
+		}()
 	}
 }
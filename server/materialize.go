@@ -0,0 +1,123 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// JobLimits bound what a single compile job may write into its job dir.
+type JobLimits struct {
+	// MaxFiles is the most files a job may ship, including the input, 0 for the default
+	MaxFiles int
+	// MaxBytes is the most bytes a job may ship, 0 for the default
+	MaxBytes int64
+}
+
+const (
+	defaultJobMaxFiles = 50000
+	defaultJobMaxBytes = 1024 * 1024 * 1024
+)
+
+func (l JobLimits) withDefaults() JobLimits {
+	if l.MaxFiles <= 0 {
+		l.MaxFiles = defaultJobMaxFiles
+	}
+	if l.MaxBytes <= 0 {
+		l.MaxBytes = defaultJobMaxBytes
+	}
+	return l
+}
+
+// materializer writes files shipped by a client into a job dir, at the mirror of their client
+// path. Paths that are relative or climb with .. are refused rather than cleaned, and no existing
+// symlink is followed, so nothing is written outside the job dir.
+type materializer struct {
+	root    string
+	limits  JobLimits
+	bytes   int64
+	written map[string]bool
+}
+
+func newMaterializer(root string, limits JobLimits) *materializer {
+	return &materializer{
+		root:    root,
+		limits:  limits,
+		written: make(map[string]bool),
+	}
+}
+
+// resolve returns the job dir path for clientPath.
+func (m *materializer) resolve(clientPath string) (string, error) {
+	if !filepath.IsAbs(clientPath) {
+		return "", newPolicyError("shipped path is not absolute: %s", clientPath)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(clientPath), "/") {
+		if elem == ".." {
+			return "", newPolicyError("shipped path climbs out of its directory: %s", clientPath)
+		}
+	}
+	res := filepath.Join(m.root, clientPath)
+	if res == m.root || !withinDir(m.root, res) {
+		return "", newPolicyError("shipped path outside of the job directory: %s", clientPath)
+	}
+	return res, nil
+}
+
+// mkdirs makes the parent dirs of path under the root, refusing to pass through anything that is
+// not a real directory.
+func (m *materializer) mkdirs(path string) error {
+	rel, err := filepath.Rel(m.root, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	cur := m.root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, elem)
+		info, err := os.Lstat(cur)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(cur, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case !info.IsDir():
+			return newPolicyError("shipped path passes through a non-directory: %s",
+				strings.TrimPrefix(cur, m.root))
+		}
+	}
+	return nil
+}
+
+// write stores dat at the mirror of clientPath, and returns the path it was written to.
+func (m *materializer) write(clientPath string, dat []byte) (string, error) {
+	path, err := m.resolve(clientPath)
+	if err != nil {
+		return "", err
+	}
+	if !m.written[path] && len(m.written) >= m.limits.MaxFiles {
+		return "", newPolicyError("job ships more than %d files", m.limits.MaxFiles)
+	}
+	if m.bytes+int64(len(dat)) > m.limits.MaxBytes {
+		return "", newPolicyError("job ships more than %d bytes", m.limits.MaxBytes)
+	}
+	if err := m.mkdirs(path); err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(dat); err != nil {
+		return "", err
+	}
+	m.bytes += int64(len(dat))
+	m.written[path] = true
+	return path, nil
+}
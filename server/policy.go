@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mmaxim.org/xcdistcc/common"
+)
+
+// policyError is returned for commands the argument policy does not allow.
+type policyError struct {
+	msg string
+}
+
+func newPolicyError(format string, args ...interface{}) policyError {
+	return policyError{
+		msg: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e policyError) Error() string {
+	return e.msg
+}
+
+type policyAction int
+
+const (
+	policyAllow policyAction = iota
+	policyDeny
+)
+
+// policyRule matches a flag as FlagArg.Text, where * in the pattern matches anything.
+type policyRule struct {
+	action policyAction
+	re     *regexp.Regexp
+}
+
+func newPolicyRule(action policyAction, pattern string) policyRule {
+	expr := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+	return policyRule{
+		action: action,
+		re:     regexp.MustCompile("^" + expr + "$"),
+	}
+}
+
+// defaultPolicyRules deny flags that load code into the compiler, read files on the server, or
+// write outside the job dir. Flags forwarded to the frontend, preprocessor or assembler can do all
+// of that, so they are denied too.
+var defaultPolicyRules = []policyRule{
+	newPolicyRule(policyDeny, "-fplugin*"),
+	newPolicyRule(policyDeny, "-fpass-plugin=*"),
+	newPolicyRule(policyDeny, "-B*"),
+	newPolicyRule(policyDeny, "--config*"),
+	newPolicyRule(policyDeny, "-fprofile-*=*"),
+	newPolicyRule(policyDeny, "-fsanitize-*list=*"),
+	newPolicyRule(policyDeny, "-fmodules-cache-path=*"),
+	newPolicyRule(policyDeny, "-fcrash-diagnostics-dir=*"),
+	newPolicyRule(policyDeny, "-fbuild-session-file=*"),
+	newPolicyRule(policyDeny, "-Xclang *"),
+	newPolicyRule(policyDeny, "-Xpreprocessor *"),
+	newPolicyRule(policyDeny, "-Xassembler *"),
+	newPolicyRule(policyDeny, "-Wp,*"),
+	newPolicyRule(policyDeny, "-Wa,*"),
+	newPolicyRule(policyDeny, "-mllvm *"),
+}
+
+// ArgPolicy decides which compiler arguments clients may run on the server. Each flag is checked
+// against the configured rules and then the default rules, and the first match decides. Flags no
+// rule matches are allowed if they are known preprocessor or compile flags, or -c.
+type ArgPolicy struct {
+	rules []policyRule
+}
+
+func NewArgPolicy() *ArgPolicy {
+	return &ArgPolicy{
+		rules: defaultPolicyRules,
+	}
+}
+
+// LoadArgPolicy reads rules from a file with one rule per line, either "allow PATTERN" or
+// "deny PATTERN". Blank lines and lines starting with # are ignored.
+func LoadArgPolicy(path string) (*ArgPolicy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open argument policy")
+	}
+	defer file.Close()
+	var rules []policyRule
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid rule on line %d: %s", lineNum, line)
+		}
+		pattern := strings.TrimSpace(fields[1])
+		switch fields[0] {
+		case "allow":
+			rules = append(rules, newPolicyRule(policyAllow, pattern))
+		case "deny":
+			rules = append(rules, newPolicyRule(policyDeny, pattern))
+		default:
+			return nil, errors.Errorf("invalid action on line %d: %s", lineNum, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read argument policy")
+	}
+	return &ArgPolicy{
+		rules: append(rules, defaultPolicyRules...),
+	}, nil
+}
+
+func (p *ArgPolicy) allowed(arg common.FlagArg) bool {
+	for _, rule := range p.rules {
+		if rule.re.MatchString(arg.Text) {
+			return rule.action == policyAllow
+		}
+	}
+	switch arg.Kind {
+	case common.FlagPreprocessor, common.FlagCompile:
+		return true
+	case common.FlagMode:
+		return arg.Text == "-c"
+	default:
+		return false
+	}
+}
+
+// Check returns a policyError naming the first flag of cmd the policy does not allow. Response
+// files are never allowed, since the driver expands them into flags the policy never sees.
+func (p *ArgPolicy) Check(cmd *common.XcodeCmd) error {
+	if args := cmd.ResponseFileArgs(); len(args) > 0 {
+		return newPolicyError("response file not allowed by server policy: %s", args[0])
+	}
+	for _, arg := range cmd.FlagArgs() {
+		if !p.allowed(arg) {
+			return newPolicyError("argument not allowed by server policy: %s", arg.Text)
+		}
+	}
+	return nil
+}
+
+// withinDir returns whether path is dir or inside it.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
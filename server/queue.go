@@ -2,11 +2,11 @@ package server
 
 import (
 	"errors"
-	"fmt"
 	"sync"
 )
 
 var errNoJobsAvailable = errors.New("no jobs available")
+var errQueueFull = errors.New("queue full")
 
 type jobQueue[T any] struct {
 	sync.Mutex
@@ -25,7 +25,7 @@ func (q *jobQueue[T]) push(job T) error {
 	q.Lock()
 	defer q.Unlock()
 	if len(q.queue) > q.maxSize {
-		return fmt.Errorf("queue full")
+		return errQueueFull
 	}
 	q.queue = append(q.queue, job)
 	for _, waiter := range q.waiters {
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mmaxim.org/xcdistcc/common"
+)
+
+// permissionError is returned for preprocess commands that touch paths outside the source roots.
+type permissionError struct {
+	msg string
+}
+
+func newPermissionError(format string, args ...interface{}) permissionError {
+	return permissionError{
+		msg: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e permissionError) Error() string {
+	return e.msg
+}
+
+// SourceRoots are the directories of a filesystem shared with clients that remote preprocessing
+// may read from. With no roots, remote preprocessing is disabled.
+type SourceRoots []string
+
+// NewSourceRoots resolves paths to the real directories they name.
+func NewSourceRoots(paths []string) (res SourceRoots, err error) {
+	for _, path := range paths {
+		if len(path) == 0 {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid source root: %s", path)
+		}
+		real, err := filepath.EvalSymlinks(abs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid source root: %s", path)
+		}
+		res = append(res, real)
+	}
+	return res, nil
+}
+
+// realPath resolves the symlinks in path. Parts of the path that do not exist yet, such as a dep
+// file about to be written, are kept as they are under their deepest existing parent.
+func realPath(path string) string {
+	path = filepath.Clean(path)
+	var rest []string
+	for {
+		if real, err := filepath.EvalSymlinks(path); err == nil {
+			return filepath.Join(append([]string{real}, rest...)...)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
+
+func (r SourceRoots) contains(path string) bool {
+	path = realPath(path)
+	for _, root := range r {
+		if withinDir(root, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreprocess returns a permissionError unless the working directory and every path cmd
+// reads or writes is inside a root.
+func (r SourceRoots) checkPreprocess(dir string, cmd *common.XcodeCmd) error {
+	if len(r) == 0 {
+		return newPermissionError("remote preprocessing is not enabled on this server")
+	}
+	if !filepath.IsAbs(dir) || !r.contains(dir) {
+		return newPermissionError("working directory not in a source root: %s", dir)
+	}
+	// checkPreprocessed needs the line markers that -P leaves out
+	for _, arg := range cmd.FlagArgs() {
+		if arg.Text == "-P" {
+			return newPermissionError("argument not allowed for remote preprocessing: %s", arg.Text)
+		}
+	}
+	paths := cmd.ReadPaths()
+	if input, err := cmd.GetInputFilepath(); err == nil {
+		paths = append(paths, input)
+	}
+	// preprocessing drops -o, but anything else that writes a file, like -MF or
+	// -serialize-diagnostics, still writes it
+	outcmd := cmd.Clone()
+	outcmd.RemoveOutputFilepath()
+	paths = append(paths, outcmd.OutputPaths()...)
+	for _, path := range paths {
+		path, err := cmd.AbsPath(path)
+		if err != nil || !r.contains(path) {
+			return newPermissionError("path not in a source root: %s", path)
+		}
+	}
+	return nil
+}
+
+// checkPreprocessed returns a permissionError if the line markers of preprocessed code name a
+// file outside the roots, which catches #include paths that no flag mentions. Relative paths are
+// resolved against the working directory of cmd. Code without line markers is rejected, since
+// nothing can be told about what it read. #embed pulls in files without leaving a line marker, so
+// unless allowEmbed is set, the files the code came from must not use it.
+func (r SourceRoots) checkPreprocessed(cmd *common.XcodeCmd, code []byte, allowEmbed bool) error {
+	scanner := bufio.NewScanner(bytes.NewReader(code))
+	scanner.Buffer(nil, len(code)+1)
+	checked := make(map[string]bool)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, []byte("# ")) {
+			continue
+		}
+		fields := strings.SplitN(string(line[2:]), " ", 2)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], `"`) {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			continue
+		}
+		end := strings.LastIndex(fields[1], `"`)
+		if end <= 0 {
+			continue
+		}
+		path, err := strconv.Unquote(fields[1][:end+1])
+		if err != nil {
+			return newPermissionError("invalid line marker: %s", line)
+		}
+		if strings.HasPrefix(path, "<") || checked[path] {
+			// <built-in> and friends
+			continue
+		}
+		if err := r.checkRead(cmd, path); err != nil {
+			return err
+		}
+		if !allowEmbed {
+			if err := checkNoEmbed(cmd, path); err != nil {
+				return err
+			}
+		}
+		checked[path] = true
+	}
+	if len(checked) == 0 {
+		return newPermissionError("preprocessed code has no line markers")
+	}
+	return nil
+}
+
+// embedDirectiveRegexp matches an #embed directive, or its %: digraph spelling, once line
+// continuations are joined.
+var embedDirectiveRegexp = regexp.MustCompile(`(?m)^[ \t]*(?:#|%:)(?:[ \t]|/\*.*?\*/)*embed\b`)
+
+// checkNoEmbed returns a permissionError if the file at path has an #embed directive.
+func checkNoEmbed(cmd *common.XcodeCmd, path string) error {
+	abspath, err := cmd.AbsPath(path)
+	if err != nil {
+		return newPermissionError("invalid preprocessed file: %s", path)
+	}
+	dat, err := os.ReadFile(abspath)
+	if err != nil {
+		return newPermissionError("failed to read preprocessed file: %s", path)
+	}
+	dat = bytes.ReplaceAll(dat, []byte("\\\r\n"), nil)
+	dat = bytes.ReplaceAll(dat, []byte("\\\n"), nil)
+	if embedDirectiveRegexp.Match(dat) {
+		return newPermissionError("#embed needs the sandbox for remote preprocessing: %s", path)
+	}
+	return nil
+}
+
+func (r SourceRoots) checkRead(cmd *common.XcodeCmd, path string) error {
+	abspath, err := cmd.AbsPath(path)
+	if err != nil || !r.contains(abspath) {
+		return newPermissionError("preprocessing read a file not in a source root: %s", path)
+	}
+	return nil
+}
+
+// diagnosticPathRegexp matches the file of a diagnostic line, like path:12:3: error: or
+// In file included from path:12:
+var diagnosticPathRegexp = regexp.MustCompile(`^(?:In file included from |\s+from )?(.+?):\d+:`)
+
+// checkDiagnostics returns a permissionError if the diagnostics of a failed preprocess quote a
+// file outside the roots.
+func (r SourceRoots) checkDiagnostics(cmd *common.XcodeCmd, output string) error {
+	checked := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		match := diagnosticPathRegexp.FindStringSubmatch(line)
+		if match == nil || strings.HasPrefix(match[1], "<") || checked[match[1]] {
+			continue
+		}
+		if err := r.checkRead(cmd, match[1]); err != nil {
+			return err
+		}
+		checked[match[1]] = true
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"sync"
 
 	"mmaxim.org/xcdistcc/common"
@@ -16,6 +17,7 @@ type compileJobRes struct {
 }
 
 type compileJob struct {
+	compiler   string
 	cmd        *common.XcodeCmd
 	code       []byte
 	includes   []common.IncludeData
@@ -24,8 +26,11 @@ type compileJob struct {
 }
 
 func newCompileJob(cmd common.CompileCmd, sourceAddr string) *compileJob {
+	xccmd := common.NewXcodeCmdFromWire(cmd.Args, cmd.Command)
+	xccmd.SetDir(cmd.Dir)
+	xccmd.SetEnv(cmd.Env)
 	return &compileJob{
-		cmd:        common.NewXcodeCmd(cmd.Command),
+		cmd:        xccmd,
 		code:       cmd.Code,
 		includes:   cmd.Includes,
 		sourceAddr: sourceAddr,
@@ -41,6 +46,7 @@ func (j *compileJob) toStatusJob() common.StatusJob {
 	return common.StatusJob{
 		SourceAddress: j.sourceAddr,
 		Filename:      filename,
+		Args:          j.cmd.GetTokens(),
 		Command:       j.cmd.GetCommand(),
 		Mode:          "Compile",
 	}
@@ -52,6 +58,7 @@ type preprocessJobRes struct {
 }
 
 type preprocessJob struct {
+	compiler   string
 	dir        string
 	cmd        *common.XcodeCmd
 	sourceAddr string
@@ -59,9 +66,12 @@ type preprocessJob struct {
 }
 
 func newPreprocessJob(cmd common.PreprocessCmd, sourceAddr string) *preprocessJob {
+	xccmd := common.NewXcodeCmdFromWire(cmd.Args, cmd.Command)
+	xccmd.SetDir(cmd.Dir)
+	xccmd.SetEnv(cmd.Env)
 	return &preprocessJob{
 		dir:        cmd.Dir,
-		cmd:        common.NewXcodeCmd(cmd.Command),
+		cmd:        xccmd,
 		sourceAddr: sourceAddr,
 		doneCh:     make(chan preprocessJobRes),
 	}
@@ -75,6 +85,7 @@ func (j *preprocessJob) toStatusJob() common.StatusJob {
 	return common.StatusJob{
 		SourceAddress: j.sourceAddr,
 		Filename:      filename,
+		Args:          j.cmd.GetTokens(),
 		Command:       j.cmd.GetCommand(),
 		Mode:          "Preprocess",
 	}
@@ -84,17 +95,35 @@ type Runner struct {
 	*common.LabelLogger
 	queue      *jobQueue[runnerJob]
 	builder    *Builder
+	cache      *compileCache
+	includes   *includeStore
+	policy     *ArgPolicy
+	roots      SourceRoots
 	numWorkers int
 
 	workerStatusMu sync.Mutex
 	workerStatus   map[int]runnerJob
 }
 
-func NewRunner(numWorkers, maxQueueSize int, logger common.Logger) *Runner {
+// NewRunner makes a runner with numWorkers workers. Commands are checked against policy, or the
+// default policy if it is nil, and built as configured by opts.
+func NewRunner(numWorkers, maxQueueSize int, maxCacheSize, maxIncludeStoreSize int64, policy *ArgPolicy,
+	opts BuilderOptions, logger common.Logger) (*Runner, error) {
+	if policy == nil {
+		policy = NewArgPolicy()
+	}
+	builder, err := NewBuilder(opts, logger)
+	if err != nil {
+		return nil, err
+	}
 	r := &Runner{
 		LabelLogger:  common.NewLabelLogger("Runner", logger),
 		queue:        newJobQueue[runnerJob](maxQueueSize),
-		builder:      NewBuilder(logger),
+		builder:      builder,
+		cache:        newCompileCache(maxCacheSize),
+		includes:     newIncludeStore(maxIncludeStoreSize, logger),
+		policy:       policy,
+		roots:        opts.Roots,
 		workerStatus: make(map[int]runnerJob),
 		numWorkers:   numWorkers,
 	}
@@ -102,7 +131,7 @@ func NewRunner(numWorkers, maxQueueSize int, logger common.Logger) *Runner {
 	for i := 0; i < numWorkers; i++ {
 		go r.workerLoop(i)
 	}
-	return r
+	return r, nil
 }
 
 func (r *Runner) runCompileJob(job *compileJob) {
@@ -112,7 +141,7 @@ func (r *Runner) runCompileJob(job *compileJob) {
 	}
 	r.Debug("compiling job: input: %s sz: %d queue: %d", inputpath,
 		len(job.code), len(r.queue.listJobs()))
-	res, err := r.builder.Compile(job.code, job.cmd, job.includes)
+	res, err := r.builder.Compile(job.compiler, job.code, job.cmd, job.includes)
 	if err != nil {
 		r.Debug("compile failed: %s", err)
 	}
@@ -129,7 +158,7 @@ func (r *Runner) runPreprocessJob(job *preprocessJob) {
 		inputpath = "???"
 	}
 	r.Debug("preprocessing job: input: %s dir: %s queue: %d", inputpath, job.dir, len(r.queue.listJobs()))
-	res, err := r.builder.Preprocess(job.dir, job.cmd)
+	res, err := r.builder.Preprocess(job.compiler, job.dir, job.cmd)
 	if err != nil {
 		r.Debug("preprocess failed: %s", err)
 	}
@@ -175,17 +204,91 @@ func (r *Runner) finishCompileJob(workerID int) {
 	delete(r.workerStatus, workerID)
 }
 
+func (r *Runner) CheckIncludes(cmd common.CheckIncludesCmd) (res common.CheckIncludesResponse) {
+	res.Missing = r.includes.missing(cmd.Digests)
+	return res
+}
+
+func (r *Runner) UploadIncludes(cmd common.UploadIncludesCmd) (res common.UploadIncludesResponse, err error) {
+	return res, r.includes.add(cmd.Blobs)
+}
+
 func (r *Runner) Compile(cmd common.CompileCmd, sourceAddr string) (res common.CompileResponse, err error) {
+	if len(cmd.IncludeRefs) > 0 {
+		resolved, err := r.includes.resolve(cmd.IncludeRefs)
+		if err != nil {
+			return res, err
+		}
+		cmd.Includes = append(cmd.Includes, resolved...)
+	}
 	job := newCompileJob(cmd, sourceAddr)
+	var toolchain *Toolchain
+	if job.compiler, toolchain, err = r.builder.toolchains.lookup(cmd.Compiler, cmd.Fingerprint); err != nil {
+		r.Debug("Compile: rejected command from %s: %s", sourceAddr, err)
+		return res, err
+	}
+	if err := toolchain.checkTarget(job.cmd); err != nil {
+		r.Debug("Compile: rejected command from %s: %s", sourceAddr, err)
+		return res, err
+	}
+	if err := r.policy.Check(job.cmd); err != nil {
+		r.Debug("Compile: rejected command from %s: %s", sourceAddr, err)
+		return res, err
+	}
+	var cacheKey string
+	if r.cache.enabled() {
+		cacheKey = compileCacheKey(job.cmd, job.code, job.includes, compilerCacheID(job.compiler))
+		if cached, ok := r.cache.get(cacheKey); ok {
+			r.Debug("cache hit: key: %s sz: %d", cacheKey, len(cached.Object))
+			return responseForVersion(cached, cmd.Version), nil
+		}
+	}
 	if err := r.queue.push(job); err != nil {
 		return res, err
 	}
 	doneRes := <-job.doneCh
-	return doneRes.res, doneRes.err
+	if doneRes.err == nil && r.cache.enabled() {
+		r.cache.put(cacheKey, doneRes.res)
+	}
+	// newer clients get compiler failures as a normal response so they can reproduce the exit code
+	var cerr compileError
+	if cmd.Version >= 1 && errors.As(doneRes.err, &cerr) {
+		return responseForVersion(doneRes.res, cmd.Version), nil
+	}
+	return responseForVersion(doneRes.res, cmd.Version), doneRes.err
+}
+
+// responseForVersion drops the parts of res that a client of the given version does not use, so
+// outputs are not sent twice.
+func responseForVersion(res common.CompileResponse, version int) common.CompileResponse {
+	if version >= 2 {
+		res.Object = nil
+		res.Dep = nil
+	} else {
+		res.Files = nil
+	}
+	return res
 }
 
 func (r *Runner) Preprocess(cmd common.PreprocessCmd, sourceAddr string) (res common.PreprocessResponse, err error) {
 	job := newPreprocessJob(cmd, sourceAddr)
+	var toolchain *Toolchain
+	if job.compiler, toolchain, err = r.builder.toolchains.lookup(cmd.Compiler, cmd.Fingerprint); err != nil {
+		r.Debug("Preprocess: rejected command from %s: %s", sourceAddr, err)
+		return res, err
+	}
+	if err := toolchain.checkTarget(job.cmd); err != nil {
+		r.Debug("Preprocess: rejected command from %s: %s", sourceAddr, err)
+		return res, err
+	}
+	if err := r.policy.Check(job.cmd); err != nil {
+		r.Debug("Preprocess: rejected command from %s: %s", sourceAddr, err)
+		return res, err
+	}
+	if err := r.roots.checkPreprocess(job.dir, job.cmd); err != nil {
+		r.Debug("Preprocess: rejected command from %s: %s", sourceAddr, err)
+		return res, err
+	}
 	if err := r.queue.push(job); err != nil {
 		return res, err
 	}
@@ -211,5 +314,9 @@ func (r *Runner) Status() (res common.StatusResponse) {
 		res.QueuedJobs = append(res.QueuedJobs, job.toStatusJob())
 	}
 	res.NumWorkers = r.numWorkers
+	res.CacheHits, res.CacheMisses = r.cache.stats()
+	res.Toolchains = r.builder.toolchains.status()
+	res.Targets = r.builder.toolchains.targets
+	res.SDKs = r.builder.toolchains.sdks
 	return res
 }
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SandboxOptions configure the isolation of compiler processes. On Linux each compiler runs in new
+// mount, PID, network and IPC namespaces, in a root that only has the system and toolchain
+// directories, read only, and the job dir, which is the only writable path.
+type SandboxOptions struct {
+	Enabled bool
+	// ReadOnlyPaths are extra paths visible in the sandbox, such as SDKs. The system directories
+	// and the compiler's toolchain are always included.
+	ReadOnlyPaths []string
+	// UID and GID to run compilers as when the daemon runs as root, 0 for the nobody user. When
+	// the daemon is not root, a user namespace maps the daemon user instead.
+	UID int
+	GID int
+	// CPUTime, MaxMemory and MaxFileSize are resource limits for each compiler, 0 for none.
+	CPUTime     time.Duration
+	MaxMemory   int64
+	MaxFileSize int64
+}
+
+// sandboxSystemPaths are the directories a compiler needs to load and run.
+var sandboxSystemPaths = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/etc"}
+
+const (
+	sandboxHelperArg = "__xcdistcc_sandbox"
+	sandboxSpecEnv   = "XCDISTCC_SANDBOX_SPEC"
+	nobodyID         = 65534
+	// sandboxStatusFD is where the helper reports a failure to set up the sandbox. It is closed on
+	// exec, so the daemon reads nothing from it once the compiler runs.
+	sandboxStatusFD = 3
+)
+
+// sandboxSpec is what the helper process needs to set up the sandbox and start the compiler.
+type sandboxSpec struct {
+	Root        string
+	JobDir      string
+	WorkDir     string
+	ReadOnly    []string
+	UserNS      bool
+	UID         int
+	GID         int
+	CPUSeconds  uint64
+	MaxMemory   uint64
+	MaxFileSize uint64
+}
+
+// RunSandboxHelper runs the sandbox helper and exits if this process was started as one. Programs
+// that run a sandboxed Runner must call it at the start of main.
+func RunSandboxHelper() {
+	if len(os.Args) < 3 || os.Args[1] != sandboxHelperArg {
+		return
+	}
+	status := os.NewFile(sandboxStatusFD, "sandbox status")
+	fail := func(err error) {
+		fmt.Fprintf(status, "%s", err)
+		fmt.Fprintf(os.Stderr, "xcdistcc sandbox: %s\n", err)
+		os.Exit(126)
+	}
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxSpecEnv)), &spec); err != nil {
+		fail(errors.Wrap(err, "invalid spec"))
+	}
+	os.Unsetenv(sandboxSpecEnv)
+	// the helper only returns if it failed to exec the compiler
+	fail(runSandboxHelper(spec, os.Args[2:]))
+}
+
+// sandboxCmd is a compiler command, run in the sandbox if status is set.
+type sandboxCmd struct {
+	*exec.Cmd
+	// status is the read end of the pipe the helper reports setup failures on
+	status *os.File
+}
+
+// Run runs the command. Failures to set up the sandbox are returned as errors of their own, not
+// as an *exec.ExitError of the compiler.
+func (c *sandboxCmd) Run() error {
+	if c.status == nil {
+		return c.Cmd.Run()
+	}
+	defer c.status.Close()
+	err := c.Cmd.Start()
+	// the helper has its own copy of the write end
+	for _, file := range c.Cmd.ExtraFiles {
+		file.Close()
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to start sandbox")
+	}
+	msg, _ := io.ReadAll(c.status)
+	err = c.Cmd.Wait()
+	if len(msg) > 0 {
+		return errors.Errorf("failed to set up sandbox: %s", msg)
+	}
+	return err
+}
+
+type sandbox struct {
+	opts SandboxOptions
+	exe  string
+}
+
+func newSandbox(opts SandboxOptions) (*sandbox, error) {
+	if !opts.Enabled {
+		return nil, nil
+	}
+	if !sandboxSupported {
+		return nil, errors.New("sandbox is not supported on this platform")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find own executable for sandbox helper")
+	}
+	if opts.UID == 0 {
+		opts.UID = nobodyID
+	}
+	if opts.GID == 0 {
+		opts.GID = nobodyID
+	}
+	return &sandbox{
+		opts: opts,
+		exe:  exe,
+	}, nil
+}
+
+// command returns a command that runs compiler with args and env in workdir, confined to jobDir
+// and the readOnly paths. root is an empty directory outside jobDir for the sandbox to be built
+// in. A nil env is the environment of the daemon.
+func (s *sandbox) command(root, jobDir, workdir, compiler string, args, env, readOnly []string) (*sandboxCmd, error) {
+	if s == nil {
+		ecmd := exec.Command(compiler, args...)
+		ecmd.Dir = workdir
+		ecmd.Env = env
+		return &sandboxCmd{Cmd: ecmd}, nil
+	}
+	if env == nil {
+		env = os.Environ()
+	}
+	userNS := os.Getuid() != 0
+	if !userNS {
+		// the compiler runs as the sandbox user, which needs to own the job dir to write outputs
+		err := filepath.WalkDir(jobDir, func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, s.opts.UID, s.opts.GID)
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to hand job dir to sandbox user")
+		}
+	}
+	paths := append([]string{filepath.Dir(filepath.Dir(compiler))}, sandboxSystemPaths...)
+	paths = append(append(paths, s.opts.ReadOnlyPaths...), readOnly...)
+	spec := sandboxSpec{
+		Root:        root,
+		JobDir:      jobDir,
+		WorkDir:     workdir,
+		ReadOnly:    paths,
+		UserNS:      userNS,
+		UID:         s.opts.UID,
+		GID:         s.opts.GID,
+		CPUSeconds:  uint64(s.opts.CPUTime / time.Second),
+		MaxMemory:   uint64(s.opts.MaxMemory),
+		MaxFileSize: uint64(s.opts.MaxFileSize),
+	}
+	dat, err := json.Marshal(spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode sandbox spec")
+	}
+	status, statusWrite, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to make sandbox status pipe")
+	}
+	ecmd := exec.Command(s.exe, append([]string{sandboxHelperArg, compiler}, args...)...)
+	ecmd.Env = append(env, sandboxSpecEnv+"="+string(dat))
+	ecmd.SysProcAttr = sandboxProcAttr(spec)
+	ecmd.ExtraFiles = []*os.File{statusWrite}
+	return &sandboxCmd{Cmd: ecmd, status: status}, nil
+}
+
+// sandboxRoot returns the directory to build the sandbox for the job in dir, next to it so the
+// compiler can not see it.
+func sandboxRoot(dir string) string {
+	return dir + ".root"
+}
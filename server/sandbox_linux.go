@@ -0,0 +1,215 @@
+//go:build linux
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const sandboxSupported = true
+
+func sandboxProcAttr(spec sandboxSpec) *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC |
+			syscall.CLONE_NEWUTS,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if spec.UserNS {
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+	}
+	return attr
+}
+
+func bindMount(src, dest string, readOnly bool) error {
+	if err := syscall.Mount(src, dest, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return errors.Wrapf(err, "failed to bind %s", src)
+	}
+	if !readOnly {
+		return nil
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV)
+	if err := syscall.Mount("", dest, "", flags, ""); err != nil {
+		return errors.Wrapf(err, "failed to make %s read only", src)
+	}
+	return nil
+}
+
+// addPath makes path from the host visible under root. Symlinks, such as /lib on merged /usr
+// systems, are copied as symlinks.
+func addPath(root, path string, readOnly bool) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	dest := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dest); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+	case info.IsDir():
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+	default:
+		file, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+	return bindMount(path, dest, readOnly)
+}
+
+func setRlimit(resource int, value uint64) error {
+	if value == 0 {
+		return nil
+	}
+	return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: value, Max: value})
+}
+
+// enterRoot makes root the root of the mount namespace and detaches the old root, so nothing of
+// the host is left to escape to.
+func enterRoot(root string) error {
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	// stacks the old root on top of the new one, where it can be detached without a mount point
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return errors.Wrap(err, "failed to pivot to sandbox root")
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return errors.Wrap(err, "failed to detach host root")
+	}
+	return os.Chdir("/")
+}
+
+// dropBoundingCaps removes every capability from the bounding set, so the compiler can not gain
+// any when it is exec'd, even as root of a user namespace.
+func dropBoundingCaps() error {
+	for capability := 0; ; capability++ {
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0)
+		if err == unix.EINVAL {
+			// past the last capability the kernel has
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "failed to drop bounding capabilities")
+		}
+	}
+}
+
+// dropCaps clears the capabilities of this thread and keeps it from gaining privileges on exec.
+func dropCaps() error {
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return errors.Wrap(err, "failed to clear ambient capabilities")
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return errors.Wrap(err, "failed to set no new privileges")
+	}
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return errors.Wrap(err, "failed to clear capabilities")
+	}
+	return nil
+}
+
+// runSandboxHelper runs as the first process of the new namespaces. It builds the sandbox root,
+// enters it, and execs the compiler.
+func runSandboxHelper(spec sandboxSpec, argv []string) error {
+	// capabilities belong to threads, and exec takes those of the thread calling it
+	runtime.LockOSThread()
+	syscall.CloseOnExec(sandboxStatusFD)
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return errors.Wrap(err, "failed to make mounts private")
+	}
+	root := spec.Root
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return errors.Wrap(err, "failed to mount sandbox root")
+	}
+	tmp := filepath.Join(root, "tmp")
+	if err := os.MkdirAll(tmp, 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return errors.Wrap(err, "failed to mount sandbox tmp")
+	}
+	// the job dir and source roots can live in /tmp, so they go on top of the tmpfs
+	for _, path := range spec.ReadOnly {
+		if err := addPath(root, path, true); err != nil {
+			return err
+		}
+	}
+	for _, dev := range []string{"/dev/null", "/dev/zero", "/dev/urandom", "/dev/random"} {
+		if err := addPath(root, dev, false); err != nil {
+			return err
+		}
+	}
+	if err := addPath(root, spec.JobDir, false); err != nil {
+		return err
+	}
+	proc := filepath.Join(root, "proc")
+	if err := os.MkdirAll(proc, 0555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return errors.Wrap(err, "failed to mount sandbox proc")
+	}
+	if err := syscall.Mount("", root, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return errors.Wrap(err, "failed to make sandbox root read only")
+	}
+	if err := enterRoot(root); err != nil {
+		return err
+	}
+	if err := os.Chdir(spec.WorkDir); err != nil {
+		return errors.Wrap(err, "failed to enter working directory")
+	}
+
+	if err := setRlimit(syscall.RLIMIT_CPU, spec.CPUSeconds); err != nil {
+		return errors.Wrap(err, "failed to limit cpu time")
+	}
+	if err := setRlimit(syscall.RLIMIT_AS, spec.MaxMemory); err != nil {
+		return errors.Wrap(err, "failed to limit memory")
+	}
+	if err := setRlimit(syscall.RLIMIT_FSIZE, spec.MaxFileSize); err != nil {
+		return errors.Wrap(err, "failed to limit file size")
+	}
+	// dropping from the bounding set needs CAP_SETPCAP, which setuid takes away
+	if err := dropBoundingCaps(); err != nil {
+		return err
+	}
+	if !spec.UserNS {
+		if err := syscall.Setgroups(nil); err != nil {
+			return errors.Wrap(err, "failed to drop groups")
+		}
+		if err := syscall.Setgid(spec.GID); err != nil {
+			return errors.Wrap(err, "failed to set gid")
+		}
+		if err := syscall.Setuid(spec.UID); err != nil {
+			return errors.Wrap(err, "failed to set uid")
+		}
+	}
+	if err := dropCaps(); err != nil {
+		return err
+	}
+	return syscall.Exec(argv[0], argv, os.Environ())
+}
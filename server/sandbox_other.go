@@ -0,0 +1,19 @@
+//go:build !linux
+
+package server
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const sandboxSupported = false
+
+func sandboxProcAttr(spec sandboxSpec) *syscall.SysProcAttr {
+	return nil
+}
+
+func runSandboxHelper(spec sandboxSpec, argv []string) error {
+	return errors.New("sandbox is not supported on this platform")
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"mmaxim.org/xcdistcc/common"
+)
+
+// llvmTargetArchs maps the LLVM targets listed by -print-targets to the architectures they build.
+var llvmTargetArchs = map[string][]string{
+	"x86-64":     {"x86_64", "x86_64h"},
+	"x86":        {"i386"},
+	"aarch64":    {"arm64", "arm64e"},
+	"arm64":      {"arm64", "arm64e"},
+	"aarch64_32": {"arm64_32"},
+	"arm64_32":   {"arm64_32"},
+	"arm":        {"armv7", "armv7s", "armv7k"},
+	"thumb":      {"armv7", "armv7s", "armv7k"},
+}
+
+// discoverArchs returns the architectures the compiler at path builds for. Compilers without
+// -print-targets build for the machine they run on.
+func discoverArchs(path string) (res []string) {
+	if out, err := common.CompilerOutput(path, "-print-targets"); err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			name, _, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+			if !ok {
+				continue
+			}
+			res = append(res, llvmTargetArchs[name]...)
+		}
+		if len(res) > 0 {
+			return res
+		}
+	}
+	if out, err := common.CompilerOutput(path, "-dumpmachine"); err == nil {
+		if arch, _, _ := strings.Cut(strings.TrimSpace(string(out)), "-"); len(arch) > 0 {
+			return []string{common.NormalizeArch(arch)}
+		}
+	}
+	return nil
+}
+
+// developerDir returns the Developer dir of the Xcode that path is in, skipping those of the
+// platforms inside it.
+func developerDir(path string) (string, bool) {
+	dir := filepath.Clean(path)
+	for filepath.Base(dir) != "Developer" || filepath.Ext(filepath.Dir(dir)) == ".platform" {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+	return dir, true
+}
+
+// discoverSDKs returns the names of the SDKs in the Xcode that the compiler at path is part of.
+func discoverSDKs(path string) (res []string) {
+	dir, ok := developerDir(filepath.Dir(path))
+	if !ok {
+		return nil
+	}
+	sdks, _ := filepath.Glob(filepath.Join(dir, "Platforms", "*.platform", "Developer", "SDKs", "*.sdk"))
+	for _, sdk := range sdks {
+		res = append(res, strings.TrimSuffix(filepath.Base(sdk), ".sdk"))
+	}
+	return res
+}
+
+// uniqueSorted returns strs sorted, without duplicates.
+func uniqueSorted(strs []string) (res []string) {
+	seen := make(map[string]bool)
+	for _, str := range strs {
+		if !seen[str] {
+			seen[str] = true
+			res = append(res, str)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
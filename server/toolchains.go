@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mmaxim.org/xcdistcc/common"
+)
+
+// toolchainError is returned for jobs that ask for a compiler the server does not have.
+type toolchainError struct {
+	msg string
+}
+
+func newToolchainError(format string, args ...interface{}) toolchainError {
+	return toolchainError{
+		msg: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e toolchainError) Error() string {
+	return e.msg
+}
+
+// Toolchain is a compiler the server runs jobs with. Clients get it by invoking any driver in the
+// same directory as Path, and jobs run with the driver of the same name in that directory.
+type Toolchain struct {
+	Name string
+	Path string
+	// Version is the first line of the compiler's --version output
+	Version string
+	// Fingerprint is common.CompilerFingerprint of the compiler, empty if it could not be run
+	Fingerprint string
+	// Targets and SDKs are the architectures and SDKs jobs run with the toolchain may build for
+	Targets []string
+	SDKs    []string
+}
+
+// driver returns the path of the driver called name in the toolchain.
+func (t *Toolchain) driver(name string) (string, bool) {
+	if !common.IsCompilerDriver(name) {
+		return "", false
+	}
+	path := filepath.Join(filepath.Dir(t.Path), name)
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// compilerCacheID returns what identifies the compiler at path in cache keys. Drivers that share a
+// binary get different ones, since they compile differently.
+func compilerCacheID(path string) string {
+	if fingerprint, err := common.CompilerFingerprint(path, nil); err == nil {
+		return filepath.Base(path) + ":" + fingerprint
+	}
+	return common.CompilerIdentity(path)
+}
+
+func compilerVersion(path string) (string, error) {
+	out, err := common.CompilerOutput(path, "--version")
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := bytes.Cut(out, common.NewLineBytes)
+	return strings.TrimSpace(string(line)), nil
+}
+
+func newToolchain(name, path string) *Toolchain {
+	if len(name) == 0 {
+		name = filepath.Dir(path)
+	}
+	version, _ := compilerVersion(path)
+	fingerprint, _ := common.CompilerFingerprint(path, nil)
+	return &Toolchain{
+		Name:        name,
+		Path:        path,
+		Version:     version,
+		Fingerprint: fingerprint,
+		Targets:     uniqueSorted(discoverArchs(path)),
+		SDKs:        uniqueSorted(discoverSDKs(path)),
+	}
+}
+
+// checkTarget returns a toolchainError if cmd builds for an architecture or SDK the toolchain does
+// not have.
+func (t *Toolchain) checkTarget(cmd *common.XcodeCmd) error {
+	if target := cmd.GetTarget(); !common.TargetSupported(t.Targets, t.SDKs, target) {
+		return newToolchainError("toolchain %s does not build for target: %s", t.Name, target)
+	}
+	return nil
+}
+
+// Toolchains are the compilers a server has. The first is the default, for clients that do not
+// say which compiler they were invoked with.
+type Toolchains struct {
+	list  []*Toolchain
+	byDir map[string]*Toolchain
+
+	// targets and sdks are what the toolchains build for together, which the status reports
+	targets []string
+	sdks    []string
+}
+
+// NewToolchains registers the compilers in specs, each a path or NAME=PATH. With no specs, the
+// only toolchain is common.DefaultCXX.
+func NewToolchains(specs []string) (*Toolchains, error) {
+	res := &Toolchains{
+		byDir: make(map[string]*Toolchain),
+	}
+	for _, spec := range specs {
+		if len(spec) == 0 {
+			continue
+		}
+		var name, path string
+		if index := strings.Index(spec, "="); index >= 0 {
+			name, path = spec[:index], spec[index+1:]
+		} else {
+			path = spec
+		}
+		if !filepath.IsAbs(path) {
+			return nil, errors.Errorf("toolchain compiler path is not absolute: %s", path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, errors.Wrapf(err, "invalid toolchain: %s", spec)
+		}
+		res.add(newToolchain(name, path))
+	}
+	if len(res.list) == 0 {
+		res.add(newToolchain("", common.DefaultCXX))
+	}
+	res.updateTargets()
+	return res, nil
+}
+
+func (t *Toolchains) updateTargets() {
+	t.targets, t.sdks = nil, nil
+	for _, toolchain := range t.list {
+		t.targets = append(t.targets, toolchain.Targets...)
+		t.sdks = append(t.sdks, toolchain.SDKs...)
+	}
+	t.targets = uniqueSorted(t.targets)
+	t.sdks = uniqueSorted(t.sdks)
+}
+
+// SetTargets overrides the architectures every toolchain was found to build for.
+func (t *Toolchains) SetTargets(targets []string) {
+	for _, toolchain := range t.list {
+		toolchain.Targets = uniqueSorted(targets)
+	}
+	t.updateTargets()
+}
+
+// SetSDKs overrides the SDKs every toolchain was found to have.
+func (t *Toolchains) SetSDKs(sdks []string) {
+	for _, toolchain := range t.list {
+		toolchain.SDKs = uniqueSorted(sdks)
+	}
+	t.updateTargets()
+}
+
+func (t *Toolchains) add(toolchain *Toolchain) {
+	dir := filepath.Dir(toolchain.Path)
+	if _, ok := t.byDir[dir]; ok {
+		return
+	}
+	t.list = append(t.list, toolchain)
+	t.byDir[dir] = toolchain
+}
+
+// lookup returns the compiler to run a job invoked with driver and the toolchain it is in, or the
+// default compiler if driver is empty. If the client sent the fingerprint of its compiler, the
+// driver must match it, and a toolchain installed elsewhere with a matching driver is used when the
+// one in the driver's directory differs.
+func (t *Toolchains) lookup(driver, fingerprint string) (string, *Toolchain, error) {
+	if len(driver) == 0 {
+		return t.list[0].Path, t.list[0], nil
+	}
+	name := filepath.Base(driver)
+	var candidates []*Toolchain
+	if toolchain, ok := t.byDir[filepath.Dir(filepath.Clean(driver))]; ok {
+		candidates = append(candidates, toolchain)
+	}
+	if len(fingerprint) > 0 {
+		candidates = append(candidates, t.list...)
+	}
+	for _, toolchain := range candidates {
+		path, ok := toolchain.driver(name)
+		if !ok {
+			continue
+		}
+		if len(fingerprint) == 0 {
+			return path, toolchain, nil
+		}
+		if other, err := common.CompilerFingerprint(path, nil); err == nil && other == fingerprint {
+			return path, toolchain, nil
+		}
+	}
+	return "", nil, newToolchainError("no toolchain matches compiler: %s", driver)
+}
+
+func (t *Toolchains) status() (res []common.StatusToolchain) {
+	for _, toolchain := range t.list {
+		res = append(res, common.StatusToolchain{
+			Name:        toolchain.Name,
+			Path:        toolchain.Path,
+			Version:     toolchain.Version,
+			Fingerprint: toolchain.Fingerprint,
+		})
+	}
+	return res
+}
@@ -9,22 +9,24 @@ import (
 )
 
 type Refresher struct {
-	remotes []client.Remote
+	remotes  []client.Remote
+	connPool *client.ConnPool
 }
 
 func NewRefresher(remotes []client.Remote) *Refresher {
 	return &Refresher{
-		remotes: remotes,
+		remotes:  remotes,
+		connPool: client.NewConnPool(),
 	}
 }
 
 func (r *Refresher) getStatus(remote client.Remote) (res []string, err error) {
-	conn, err := client.DialRemote(remote)
+	conn, err := r.connPool.Get(remote)
 	if err != nil {
 		return nil, err
 	}
-	status, err := common.DoRPC[common.StatusCmd, common.StatusResponse](conn.Conn, common.MethodStatus,
-		common.StatusCmd{}, conn.Secret)
+	status, err := common.DoRPC[common.StatusCmd, common.StatusResponse](conn, common.MethodStatus,
+		common.StatusCmd{})
 	if err != nil {
 		return nil, err
 	}